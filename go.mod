@@ -17,9 +17,9 @@ require (
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
+	github.com/prometheus/client_golang v1.7.1
 	github.com/reconquest/karma-go v0.0.0-20200928103525-22da92476de6
 	github.com/reconquest/pkg v0.0.0-20200921103402-ae5124ffc1a9
-	github.com/reconquest/stats-go v0.0.0-20180307085907-df9f297af353
 	go.mongodb.org/mongo-driver v1.4.1
 	google.golang.org/grpc v1.32.0 // indirect
 	gopkg.in/yaml.v2 v2.3.0
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/kovetskiy/ko"
+	"github.com/reconquest/karma-go"
 	"gopkg.in/yaml.v2"
 )
 
@@ -14,18 +19,107 @@ type Bitbucket struct {
 	URL                       string `yaml:"url" required:"true"`
 	Username                  string `yaml:"username" required:"true"`
 	Password                  string `yaml:"password" required:"true"`
-	Version                   string `yaml:"version" required:"true" env:"BITBUCKET_VERSION"`
+	Version                   string `yaml:"version" env:"BITBUCKET_VERSION"`
+	Image                     string `yaml:"image" default:"atlassian/bitbucket-server" env:"BITBUCKET_IMAGE"`
+	AddonKey                  string `yaml:"addon_key" default:"io.reconquest.snake" env:"ADDON_KEY"`
 	JvmSupportRecommendedArgs string `yaml:"jvm_support_recommended_args" required:"true" env:"JVM_SUPPORT_RECOMMENDED_ARGS"`
 	ServerProxyName           string `yaml:"server_proxy_name" required:"true" env:"SERVER_PROXY_NAME"`
 	ElasticSearchEnabled      string `yaml:"elastic_search_enabled" required:"true" env:"ELASTICSEARCH_ENABLED"`
 }
 
+type Lease struct {
+	DefaultTTL time.Duration `yaml:"default_ttl" default:"1h" env:"LEASE_DEFAULT_TTL"`
+	MaxTTL     time.Duration `yaml:"max_ttl" default:"4h" env:"LEASE_MAX_TTL"`
+}
+
+type Pool struct {
+	MinFree           int           `yaml:"min_free" default:"2" env:"POOL_MIN_FREE"`
+	MaxTotal          int           `yaml:"max_total" default:"6" env:"POOL_MAX_TOTAL"`
+	ReplenishInterval time.Duration `yaml:"replenish_interval" default:"30s" env:"POOL_REPLENISH_INTERVAL"`
+}
+
+type BitbucketPool struct {
+	Version                   string `yaml:"version" required:"true"`
+	MinFree                   int    `yaml:"min_free"`
+	MaxTotal                  int    `yaml:"max_total"`
+	JvmSupportRecommendedArgs string `yaml:"jvm_support_recommended_args"`
+}
+
+// Profile bundles settings of provisioned containers, omitted settings are
+// taken from the bitbucket section and command line options.
+type Profile struct {
+	Name                      string            `yaml:"name" required:"true"`
+	Image                     string            `yaml:"image"`
+	Env                       map[string]string `yaml:"env"`
+	JvmSupportRecommendedArgs string            `yaml:"jvm_support_recommended_args"`
+	ElasticSearchEnabled      string            `yaml:"elastic_search_enabled"`
+	AddonKey                  string            `yaml:"addon_key"`
+	Addons                    []string          `yaml:"addons"`
+	License                   string            `yaml:"license"`
+	Seed                      string            `yaml:"seed"`
+}
+
+type Queue struct {
+	Timeout time.Duration `yaml:"timeout" default:"10m" env:"QUEUE_TIMEOUT"`
+}
+
+type Provisioning struct {
+	StartupTimeout       time.Duration `yaml:"startup_timeout" default:"15m" env:"PROVISIONING_STARTUP_TIMEOUT"`
+	Quarantine           bool          `yaml:"quarantine" env:"PROVISIONING_QUARANTINE"`
+	Concurrency          int           `yaml:"concurrency" default:"2" env:"PROVISIONING_CONCURRENCY"`
+	MinAvailableMemoryMB int           `yaml:"min_available_memory_mb" env:"PROVISIONING_MIN_AVAILABLE_MEMORY_MB"`
+}
+
+type Jobs struct {
+	Retention time.Duration `yaml:"retention" default:"1h" env:"JOBS_RETENTION"`
+}
+
+type GC struct {
+	Interval    time.Duration `yaml:"interval" default:"10m" env:"GC_INTERVAL"`
+	GracePeriod time.Duration `yaml:"grace_period" default:"1h" env:"GC_GRACE_PERIOD"`
+	DryRun      bool          `yaml:"dry_run" env:"GC_DRY_RUN"`
+}
+
+type Timeouts struct {
+	Pull    time.Duration `yaml:"pull" default:"30m" env:"TIMEOUT_PULL"`
+	Start   time.Duration `yaml:"start" default:"2m" env:"TIMEOUT_START"`
+	Stop    time.Duration `yaml:"stop" default:"2m" env:"TIMEOUT_STOP"`
+	Request time.Duration `yaml:"request" default:"30s" env:"TIMEOUT_REQUEST"`
+}
+
+type Supervisor struct {
+	MinBackoff time.Duration `yaml:"min_backoff" default:"1s" env:"SUPERVISOR_MIN_BACKOFF"`
+	MaxBackoff time.Duration `yaml:"max_backoff" default:"5m" env:"SUPERVISOR_MAX_BACKOFF"`
+}
+
+type Shutdown struct {
+	Timeout  time.Duration `yaml:"timeout" default:"5m" env:"SHUTDOWN_TIMEOUT"`
+	Teardown bool          `yaml:"teardown" env:"SHUTDOWN_TEARDOWN"`
+}
+
+type Cleaner struct {
+	Interval time.Duration `yaml:"interval" default:"20s" env:"CLEANER_INTERVAL"`
+}
+
 type Config struct {
-	Prefix        string    `yaml:"prefix" required:"true"`
-	BaseURL       string    `yaml:"base_url" required:"true"`
-	ListeningPort string    `yaml:"listening_port" required:"true"`
-	Database      Database  `yaml:"database" required:"true"`
-	Bitbucket     Bitbucket `yaml:"bitbucket" required:"true"`
+	Prefix        string          `yaml:"prefix" required:"true"`
+	BaseURL       string          `yaml:"base_url" required:"true"`
+	BaseURLV2     string          `yaml:"base_url_v2" default:"/api/v2/bitbucket/servers" env:"BASE_URL_V2"`
+	ListeningPort string          `yaml:"listening_port" required:"true"`
+	Database      Database        `yaml:"database" required:"true"`
+	Bitbucket     Bitbucket       `yaml:"bitbucket" required:"true"`
+	Lease         Lease           `yaml:"lease"`
+	Pool          Pool            `yaml:"pool"`
+	Pools         []BitbucketPool `yaml:"pools"`
+	Profiles      []Profile       `yaml:"profiles"`
+	Queue         Queue           `yaml:"queue"`
+	Jobs          Jobs            `yaml:"jobs"`
+	Provisioning  Provisioning    `yaml:"provisioning"`
+	Cleaner       Cleaner         `yaml:"cleaner"`
+	GC            GC              `yaml:"gc"`
+	Timeouts      Timeouts        `yaml:"timeouts"`
+	Supervisor    Supervisor      `yaml:"supervisor"`
+	Shutdown      Shutdown        `yaml:"shutdown"`
 }
 
 func Load(path string) (*Config, error) {
@@ -35,5 +129,151 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	config.setupPools()
+	config.setupProfiles()
+
+	err = config.validate()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"invalid configuration",
+		)
+	}
+
 	return config, nil
 }
+
+// setupPools makes a single pool out of bitbucket.version and pool settings
+// if no pools are configured and fills omitted pool settings with the
+// global ones.
+func (config *Config) setupPools() {
+	if len(config.Pools) == 0 && config.Bitbucket.Version != "" {
+		config.Pools = []BitbucketPool{
+			{
+				Version: config.Bitbucket.Version,
+				MinFree: config.Pool.MinFree,
+			},
+		}
+	}
+
+	for i := range config.Pools {
+		pool := &config.Pools[i]
+		if pool.MaxTotal == 0 {
+			pool.MaxTotal = config.Pool.MaxTotal
+		}
+
+		if pool.JvmSupportRecommendedArgs == "" {
+			pool.JvmSupportRecommendedArgs =
+				config.Bitbucket.JvmSupportRecommendedArgs
+		}
+	}
+}
+
+// setupProfiles fills omitted profile settings with the bitbucket ones,
+// addons and license are left for command line options.
+func (config *Config) setupProfiles() {
+	for i := range config.Profiles {
+		profile := &config.Profiles[i]
+		if profile.Image == "" {
+			profile.Image = config.Bitbucket.Image
+		}
+
+		if profile.ElasticSearchEnabled == "" {
+			profile.ElasticSearchEnabled = config.Bitbucket.ElasticSearchEnabled
+		}
+
+		if profile.AddonKey == "" {
+			profile.AddonKey = config.Bitbucket.AddonKey
+		}
+	}
+}
+
+func (config *Config) validate() error {
+	if len(config.Pools) == 0 {
+		return errors.New("either bitbucket.version or pools must be specified")
+	}
+
+	versions := map[string]bool{}
+	minFree := 0
+	for _, pool := range config.Pools {
+		switch {
+		case versions[pool.Version]:
+			return fmt.Errorf("pool %s is specified twice", pool.Version)
+		case pool.MinFree < 0:
+			return fmt.Errorf("pool %s: min_free must not be negative", pool.Version)
+		case pool.MaxTotal < 1:
+			return fmt.Errorf("pool %s: max_total must be positive", pool.Version)
+		case pool.MinFree > pool.MaxTotal:
+			return fmt.Errorf(
+				"pool %s: min_free must not exceed max_total", pool.Version,
+			)
+		}
+
+		versions[pool.Version] = true
+		minFree += pool.MinFree
+	}
+
+	if minFree > config.Pool.MaxTotal {
+		return errors.New("sum of pools min_free must not exceed pool.max_total")
+	}
+
+	profiles := map[string]bool{}
+	for _, profile := range config.Profiles {
+		if profiles[profile.Name] {
+			return fmt.Errorf("profile %s is specified twice", profile.Name)
+		}
+
+		profiles[profile.Name] = true
+	}
+
+	switch {
+	case config.Pool.MinFree < 0:
+		return errors.New("pool.min_free must not be negative")
+	case config.Pool.MaxTotal < 1:
+		return errors.New("pool.max_total must be positive")
+	case config.Pool.MinFree > config.Pool.MaxTotal:
+		return errors.New("pool.min_free must not exceed pool.max_total")
+	case config.Pool.ReplenishInterval <= 0:
+		return errors.New("pool.replenish_interval must be positive")
+	case config.Queue.Timeout <= 0:
+		return errors.New("queue.timeout must be positive")
+	case config.Provisioning.StartupTimeout <= 0:
+		return errors.New("provisioning.startup_timeout must be positive")
+	case config.Provisioning.Concurrency < 1:
+		return errors.New("provisioning.concurrency must be positive")
+	case config.Provisioning.MinAvailableMemoryMB < 0:
+		return errors.New(
+			"provisioning.min_available_memory_mb must not be negative",
+		)
+	case config.Jobs.Retention <= 0:
+		return errors.New("jobs.retention must be positive")
+	case config.Cleaner.Interval <= 0:
+		return errors.New("cleaner.interval must be positive")
+	case config.GC.Interval <= 0:
+		return errors.New("gc.interval must be positive")
+	case config.GC.GracePeriod < 0:
+		return errors.New("gc.grace_period must not be negative")
+	case config.Timeouts.Pull <= 0:
+		return errors.New("timeouts.pull must be positive")
+	case config.Timeouts.Start <= 0:
+		return errors.New("timeouts.start must be positive")
+	case config.Timeouts.Stop <= 0:
+		return errors.New("timeouts.stop must be positive")
+	case config.Timeouts.Request <= 0:
+		return errors.New("timeouts.request must be positive")
+	case config.Supervisor.MinBackoff <= 0:
+		return errors.New("supervisor.min_backoff must be positive")
+	case config.Supervisor.MinBackoff > config.Supervisor.MaxBackoff:
+		return errors.New(
+			"supervisor.min_backoff must not exceed supervisor.max_backoff",
+		)
+	case config.Shutdown.Timeout <= 0:
+		return errors.New("shutdown.timeout must be positive")
+	case config.Lease.DefaultTTL <= 0:
+		return errors.New("lease.default_ttl must be positive")
+	case config.Lease.DefaultTTL > config.Lease.MaxTTL:
+		return errors.New("lease.default_ttl must not exceed lease.max_ttl")
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+prefix: bitbucket-pool
+base_url: /api/v1/bitbucket/servers
+listening_port: ":8080"
+database:
+  uri: mongodb://localhost:27017
+  name: pool
+bitbucket:
+  url: bitbucket.local
+  username: admin
+  password: admin
+  jvm_support_recommended_args: -Xmx1g
+  server_proxy_name: bitbucket.local
+  elastic_search_enabled: "false"
+`
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		err   string
+	}{
+		{
+			name:  "defaults",
+			extra: "  version: 6.8.0\n",
+		},
+		{
+			name: "pools",
+			extra: `
+pools:
+  - version: 6.8.0
+    min_free: 1
+  - version: 7.6.0
+    min_free: 1
+profiles:
+  - name: default
+  - name: mirror
+`,
+		},
+		{
+			name: "no pools",
+			err:  "either bitbucket.version or pools must be specified",
+		},
+		{
+			name: "duplicate pool",
+			extra: `
+pools:
+  - version: 6.8.0
+  - version: 6.8.0
+`,
+			err: "pool 6.8.0 is specified twice",
+		},
+		{
+			name: "pools min_free above pool max_total",
+			extra: `
+pool:
+  max_total: 3
+pools:
+  - version: 6.8.0
+    min_free: 2
+  - version: 7.6.0
+    min_free: 2
+`,
+			err: "sum of pools min_free must not exceed pool.max_total",
+		},
+		{
+			name: "duplicate profile",
+			extra: `  version: 6.8.0
+profiles:
+  - name: mirror
+  - name: mirror
+`,
+			err: "profile mirror is specified twice",
+		},
+		{
+			name: "min_free above max_total",
+			extra: `  version: 6.8.0
+pool:
+  min_free: 3
+  max_total: 2
+`,
+			err: "pool 6.8.0: min_free must not exceed max_total",
+		},
+		{
+			name: "negative replenish_interval",
+			extra: `  version: 6.8.0
+pool:
+  replenish_interval: -1s
+`,
+			err: "pool.replenish_interval must be positive",
+		},
+		{
+			name: "negative concurrency",
+			extra: `  version: 6.8.0
+provisioning:
+  concurrency: -1
+`,
+			err: "provisioning.concurrency must be positive",
+		},
+		{
+			name: "min_backoff above max_backoff",
+			extra: `  version: 6.8.0
+supervisor:
+  min_backoff: 10m
+  max_backoff: 1m
+`,
+			err: "supervisor.min_backoff must not exceed supervisor.max_backoff",
+		},
+		{
+			name: "default_ttl above max_ttl",
+			extra: `  version: 6.8.0
+lease:
+  default_ttl: 5h
+  max_ttl: 1h
+`,
+			err: "lease.default_ttl must not exceed lease.max_ttl",
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+
+		err := ioutil.WriteFile(path, []byte(testConfig+test.extra), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := Load(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if len(config.Pools) == 0 {
+			t.Errorf("%s: no pools configured", test.name)
+		}
+
+		for _, pool := range config.Pools {
+			if pool.MaxTotal != config.Pool.MaxTotal ||
+				pool.JvmSupportRecommendedArgs != "-Xmx1g" {
+				t.Errorf("%s: pool is not set up: %+v", test.name, pool)
+			}
+		}
+
+		for _, profile := range config.Profiles {
+			if profile.Image != config.Bitbucket.Image ||
+				profile.AddonKey != config.Bitbucket.AddonKey {
+				t.Errorf("%s: profile is not set up: %+v", test.name, profile)
+			}
+		}
+	}
+}
@@ -1,23 +1,86 @@
 package constants
 
-import "time"
-
 const (
-	BITBUCKET_IMAGE              = "atlassian/bitbucket-server"
-	ADDON_KEY                    = "io.reconquest.snake"
-	MAX_NUMBER_OF_CONTAINERS     = 6
-	INITIAL_NUMBER_OF_CONTAINERS = 2
-
-	CLEANING_INTERVAL          = 1 * time.Hour
 	IS_ALLOCATED_TRUE          = true
 	ALLOCATED_CONTAINER_STATUS = "allocated"
 	NEW_CONTAINER_STATUS       = "new"
 
 	CONTAINER_STATUS_STARTED = "STARTED"
 	CONTAINER_STATUS_EXITED  = "Exited"
+	CONTAINER_STATUS_CREATED = "Created"
 	CONTAINER_STATUS_UP      = "Up"
 	CONTAINER_STATUS_UNKNOWN = "Unknown"
 
+	LEASE_OUTCOME_RETURNED = "returned"
+	LEASE_OUTCOME_RECYCLED = "recycled"
+	LEASE_OUTCOME_EXPIRED  = "expired"
+	LEASE_OUTCOME_REMOVED  = "removed"
+	LEASE_OUTCOME_LOST     = "lost"
+
+	JOB_PHASE_PENDING          = "pending"
+	JOB_PHASE_PULLING          = "pulling"
+	JOB_PHASE_STARTING         = "starting"
+	JOB_PHASE_BOOTING          = "booting"
+	JOB_PHASE_INSTALLING_ADDON = "installing-addon"
+	JOB_PHASE_LICENSING        = "licensing"
+	JOB_PHASE_READY            = "ready"
+	JOB_PHASE_FAILED           = "failed"
+	JOB_PHASE_CANCELLED        = "cancelled"
+
+	JOB_EVENT_STATE     = "state"
+	JOB_EVENT_PHASE     = "phase"
+	JOB_EVENT_PROGRESS  = "progress"
+	JOB_EVENT_PULL      = "pull"
+	JOB_EVENT_CONTAINER = "container"
+	JOB_EVENT_FINISHED  = "finished"
+
+	JOB_EVENTS_BUFFER_SIZE = 100
+
+	LABEL_MANAGER    = "io.reconquest.bitbucket-pool-manager.prefix"
+	LABEL_POOL       = "io.reconquest.bitbucket-pool-manager.pool"
+	LABEL_PROFILE    = "io.reconquest.bitbucket-pool-manager.profile"
+	LABEL_IMAGE      = "io.reconquest.bitbucket-pool-manager.image"
+	LABEL_PORT_HTTP  = "io.reconquest.bitbucket-pool-manager.port.http"
+	LABEL_PORT_SSH   = "io.reconquest.bitbucket-pool-manager.port.ssh"
+	LABEL_ADDON_HASH = "io.reconquest.bitbucket-pool-manager.addon.hash"
+	LABEL_CREATED_AT = "io.reconquest.bitbucket-pool-manager.created-at"
+
+	BITBUCKET_HOME_PATH = "/var/atlassian/application-data/bitbucket"
+
+	QUARANTINE_SUFFIX = "-quarantined"
+
+	ORPHAN_KIND_VOLUME = "volume"
+
+	RECONCILE_ACTION_KEPT      = "kept"
+	RECONCILE_ACTION_RESTARTED = "restarted"
+	RECONCILE_ACTION_REPLACED  = "replaced"
+	RECONCILE_ACTION_REMOVED   = "removed"
+	RECONCILE_ACTION_REPORTED  = "reported"
+
+	CONTAINER_STATE_FREE         = "free"
+	CONTAINER_STATE_LEASED       = "leased"
+	CONTAINER_STATE_PROVISIONING = "provisioning"
+	CONTAINER_STATE_FAILED       = "failed"
+	CONTAINER_STATE_STOPPED      = "stopped"
+
+	SORT_CREATED = "created"
+	SORT_EXPIRES = "expires"
+
+	ORDER_ASC  = "asc"
+	ORDER_DESC = "desc"
+
+	ALLOCATION_SOURCE_FREE        = "free"
+	ALLOCATION_SOURCE_PROVISIONED = "provisioned"
+	ALLOCATION_SOURCE_QUEUED      = "queued"
+
+	ERROR_KIND_NOT_FOUND           = "not_found"
+	ERROR_KIND_CAPACITY_EXHAUSTED  = "capacity_exhausted"
+	ERROR_KIND_PROVISIONING_FAILED = "provisioning_failed"
+	ERROR_KIND_CONFLICT            = "conflict"
+	ERROR_KIND_INVALID_INPUT       = "invalid_input"
+	ERROR_KIND_UNAVAILABLE         = "unavailable"
+	ERROR_KIND_INTERNAL            = "internal"
+
 	DOCKER_NETWORK_NAME = ""
 	TIME_FORMAT         = "2006-Jan-2-15:04:07"
 )
@@ -0,0 +1,325 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	containersCollection = "containers"
+	leasesCollection     = "leases"
+)
+
+type DatabaseService interface {
+	SaveContainer(container docker.ContainerData) error
+	SetContainerAllocation(id string, isAllocated bool, allocatedTime time.Time) error
+	RemoveContainer(id string, removedAt time.Time) error
+	QuarantineContainer(id string, reason string, quarantinedAt time.Time) error
+	SetContainerAddonVersion(id string, version string) error
+	GetContainers() ([]docker.ContainerData, error)
+	SaveLease(lease Lease) error
+	GetActiveLeases() ([]Lease, error)
+	GetLeasesByContainerID(id string) ([]Lease, error)
+	Ping(ctx context.Context) error
+}
+
+type Database struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+type Lease struct {
+	ID          string     `json:"id" bson:"_id"`
+	ContainerID string     `json:"containerID" bson:"container_id"`
+	Owner       string     `json:"owner,omitempty" bson:"owner"`
+	CreatedAt   time.Time  `json:"createdAt" bson:"created_at"`
+	ExpiresAt   time.Time  `json:"expiresAt" bson:"expires_at"`
+	ReleasedAt  *time.Time `json:"releasedAt,omitempty" bson:"released_at,omitempty"`
+	Outcome     string     `json:"outcome,omitempty" bson:"outcome,omitempty"`
+}
+
+func NewDatabase(config config.Database) (*Database, error) {
+	log.Infof(nil, "connecting to database: %s", config.DatabaseName)
+	client, err := mongo.Connect(
+		context.Background(),
+		options.Client().ApplyURI(config.DatabaseURI),
+	)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to connect to database",
+		)
+	}
+
+	err = client.Ping(context.Background(), readpref.Primary())
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to ping database",
+		)
+	}
+
+	database := &Database{
+		client:   client,
+		database: client.Database(config.DatabaseName),
+	}
+
+	err = database.createIndexes()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to create indexes",
+		)
+	}
+
+	return database, nil
+}
+
+func (database *Database) Ping(ctx context.Context) error {
+	err := database.client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to ping database",
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) createIndexes() error {
+	_, err := database.database.Collection(containersCollection).Indexes().
+		CreateOne(
+			context.Background(),
+			mongo.IndexModel{
+				Keys:    bson.M{"container_id": 1},
+				Options: options.Index().SetUnique(true),
+			},
+		)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to create index for collection: %s",
+			containersCollection,
+		)
+	}
+
+	_, err = database.database.Collection(leasesCollection).Indexes().
+		CreateOne(
+			context.Background(),
+			mongo.IndexModel{
+				Keys: bson.M{"container_id": 1},
+			},
+		)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to create index for collection: %s",
+			leasesCollection,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) SaveContainer(container docker.ContainerData) error {
+	_, err := database.database.Collection(containersCollection).ReplaceOne(
+		context.Background(),
+		bson.M{"container_id": container.ID},
+		container,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to save container, container_id: %s",
+			container.ID,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) SetContainerAllocation(
+	id string,
+	isAllocated bool,
+	allocatedTime time.Time,
+) error {
+	_, err := database.database.Collection(containersCollection).UpdateOne(
+		context.Background(),
+		bson.M{"container_id": id},
+		bson.M{
+			"$set": bson.M{
+				"is_allocated":   isAllocated,
+				"allocated_time": allocatedTime,
+			},
+		},
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to update container allocation, container_id: %s",
+			id,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) RemoveContainer(id string, removedAt time.Time) error {
+	_, err := database.database.Collection(containersCollection).UpdateOne(
+		context.Background(),
+		bson.M{"container_id": id},
+		bson.M{
+			"$set": bson.M{
+				"is_allocated": false,
+				"removed_at":   removedAt,
+			},
+		},
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to mark container as removed, container_id: %s",
+			id,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) QuarantineContainer(
+	id string,
+	reason string,
+	quarantinedAt time.Time,
+) error {
+	_, err := database.database.Collection(containersCollection).UpdateOne(
+		context.Background(),
+		bson.M{"container_id": id},
+		bson.M{
+			"$set": bson.M{
+				"quarantined_at":    quarantinedAt,
+				"quarantine_reason": reason,
+			},
+		},
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to mark container as quarantined, container_id: %s",
+			id,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) SetContainerAddonVersion(
+	id string,
+	version string,
+) error {
+	_, err := database.database.Collection(containersCollection).UpdateOne(
+		context.Background(),
+		bson.M{"container_id": id},
+		bson.M{
+			"$set": bson.M{
+				"addon_version": version,
+			},
+		},
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to set addon version of container, container_id: %s",
+			id,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) GetContainers() ([]docker.ContainerData, error) {
+	cursor, err := database.database.Collection(containersCollection).Find(
+		context.Background(),
+		bson.M{"removed_at": bson.M{"$exists": false}},
+	)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to find containers",
+		)
+	}
+
+	var containers []docker.ContainerData
+	err = cursor.All(context.Background(), &containers)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to decode containers",
+		)
+	}
+
+	return containers, nil
+}
+
+func (database *Database) SaveLease(lease Lease) error {
+	_, err := database.database.Collection(leasesCollection).ReplaceOne(
+		context.Background(),
+		bson.M{"_id": lease.ID},
+		lease,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to save lease, lease_id: %s",
+			lease.ID,
+		)
+	}
+
+	return nil
+}
+
+func (database *Database) GetActiveLeases() ([]Lease, error) {
+	return database.findLeases(
+		bson.M{"released_at": bson.M{"$exists": false}},
+	)
+}
+
+func (database *Database) GetLeasesByContainerID(id string) ([]Lease, error) {
+	return database.findLeases(bson.M{"container_id": id})
+}
+
+func (database *Database) findLeases(filter bson.M) ([]Lease, error) {
+	cursor, err := database.database.Collection(leasesCollection).Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.M{"created_at": 1}),
+	)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to find leases",
+		)
+	}
+
+	var leases []Lease
+	err = cursor.All(context.Background(), &leases)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to decode leases",
+		)
+	}
+
+	return leases, nil
+}
@@ -2,15 +2,17 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
@@ -19,20 +21,44 @@ import (
 	"github.com/reconquest/pkg/log"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/metrics"
 )
 
 type DockerService interface {
-	CreateContainer(name, image, portHTTP, portSSH string) (string, error)
-	StartContainer(string) error
-	RemoveContainer(string) error
-	StopContainer(string) error
-	GetContainersListByPrefix(string) ([]types.Container, error)
-	GetContainersByIDs([]string) ([]types.Container, error)
-	GetContainerByID(string) (*types.Container, error)
-	GetFreeContainers() ([]types.Container, error)
-	GetAllocatedContainers() ([]types.Container, error)
-	SetAllocatedStatusForContainer(container types.Container) error
-	CreateNetwork() error
+	PullImage(
+		ctx context.Context,
+		image string,
+		progress func(PullProgress),
+	) error
+	CreateContainer(
+		ctx context.Context,
+		name, image, portHTTP, portSSH string,
+		env []string,
+		labels map[string]string,
+	) (string, error)
+	CopyToContainer(
+		ctx context.Context,
+		id, path string,
+		archive io.Reader,
+	) error
+	StartContainer(ctx context.Context, id string) error
+	RemoveContainer(ctx context.Context, id string) error
+	RenameContainer(ctx context.Context, id, name string) error
+	RemoveVolume(ctx context.Context, name string) error
+	StopContainer(ctx context.Context, id string) error
+	GetContainersListByPrefix(
+		ctx context.Context,
+		prefix string,
+	) ([]types.Container, error)
+	GetContainersByIDs(
+		ctx context.Context,
+		ids []string,
+	) ([]types.Container, error)
+	GetContainerByID(ctx context.Context, id string) (*types.Container, error)
+	GetContainers(ctx context.Context) ([]types.Container, error)
+	GetLegacyContainers(ctx context.Context) ([]types.Container, error)
+	CreateNetwork(ctx context.Context) error
+	Ping(ctx context.Context) error
 }
 
 type Docker struct {
@@ -41,16 +67,42 @@ type Docker struct {
 }
 
 type ContainerData struct {
-	Name          string    `json:"name" bson:"name"`
-	Image         string    `json:"image" bson:"image"`
-	ID            string    `json:"containerID" bson:"container_id"`
-	Username      string    `json:"username" bson:"username"`
-	Password      string    `json:"password" bson:"password"`
-	PortHTTP      string    `json:"httpPort" bson:"http_port"`
-	PortSSH       string    `json:"sshPort" bson:"ssh_port"`
-	Date          time.Time `json:"date" bson:"date"`
-	IsAllocated   bool      `json:"isAllocated" bson:"is_allocated"`
-	AllocatedTime time.Time `json:"allocatedTime" bson:"allocated_time"`
+	Name          string     `json:"name" bson:"name"`
+	Image         string     `json:"image" bson:"image"`
+	ID            string     `json:"containerID" bson:"container_id"`
+	Username      string     `json:"username" bson:"username"`
+	Password      string     `json:"password" bson:"password"`
+	PortHTTP      string     `json:"httpPort" bson:"http_port"`
+	PortSSH       string     `json:"sshPort" bson:"ssh_port"`
+	Date          time.Time  `json:"date" bson:"date"`
+	Pool          string     `json:"pool" bson:"pool"`
+	Profile       string     `json:"profile,omitempty" bson:"profile,omitempty"`
+	IsAllocated   bool       `json:"isAllocated" bson:"is_allocated"`
+	AllocatedTime time.Time  `json:"allocatedTime" bson:"allocated_time"`
+	AddonHash     string     `json:"addonHash" bson:"addon_hash"`
+	AddonVersion  string     `json:"addonVersion,omitempty" bson:"addon_version,omitempty"`
+	RemovedAt     *time.Time `json:"removedAt,omitempty" bson:"removed_at,omitempty"`
+
+	QuarantinedAt    *time.Time `json:"quarantinedAt,omitempty" bson:"quarantined_at,omitempty"`
+	QuarantineReason string     `json:"quarantineReason,omitempty" bson:"quarantine_reason,omitempty"`
+}
+
+// PullProgress is reported for every layer of the image while it's pulled.
+type PullProgress struct {
+	Layer   string `json:"layer,omitempty"`
+	Status  string `json:"status"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+}
+
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
 }
 
 func NewDocker(cli *client.Client, config *config.Config) *Docker {
@@ -76,7 +128,12 @@ func (docker *Docker) createHostConfig(
 			{
 				Type:   mount.TypeVolume,
 				Source: volumeName,
-				Target: "/var/atlassian/application-data/bitbucket",
+				Target: constants.BITBUCKET_HOME_PATH,
+				VolumeOptions: &mount.VolumeOptions{
+					Labels: map[string]string{
+						constants.LABEL_MANAGER: docker.config.Prefix,
+					},
+				},
 			},
 		},
 		PortBindings: nat.PortMap{
@@ -111,44 +168,89 @@ func (docker *Docker) createNetworkConfig() *network.NetworkingConfig {
 	return networkConfig
 }
 
-func (docker *Docker) CreateContainer(
-	name, image, portHTTP, portSSH string,
-) (string, error) {
+// PullImage pulls the image and reports progress of every layer, the pull
+// is aborted after timeouts.pull.
+func (docker *Docker) PullImage(
+	ctx context.Context,
+	image string,
+	progress func(PullProgress),
+) error {
+	ctx, cancel := context.WithTimeout(ctx, docker.config.Timeouts.Pull)
+	defer cancel()
+
 	log.Infof(nil, "pulling image: %s", image)
 	reader, err := docker.cli.ImagePull(
-		context.Background(), image, types.ImagePullOptions{},
+		ctx, image, types.ImagePullOptions{},
 	)
 	if err != nil {
-		return "", karma.Format(
+		countError("image_pull")
+
+		return karma.Format(
 			err,
-			"unable to create image",
+			"unable to pull image: %s",
+			image,
 		)
 	}
 
-	_, err = io.Copy(os.Stdout, reader)
-	if err != nil {
-		return "", karma.Format(
-			err,
-			"unable to copy stdout to reader",
-		)
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var message pullMessage
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to decode pull progress of image: %s",
+				image,
+			)
+		}
+
+		if message.Error != "" {
+			countError("image_pull")
+
+			return karma.Format(
+				errors.New(message.Error),
+				"unable to pull image: %s",
+				image,
+			)
+		}
+
+		log.Tracef(nil, "%s: %s %s", image, message.ID, message.Status)
+
+		progress(PullProgress{
+			Layer:   message.ID,
+			Status:  message.Status,
+			Current: message.Progress.Current,
+			Total:   message.Progress.Total,
+		})
 	}
 
+	return nil
+}
+
+func (docker *Docker) CreateContainer(
+	ctx context.Context,
+	name, image, portHTTP, portSSH string,
+	env []string,
+	labels map[string]string,
+) (string, error) {
 	hostConfig := docker.createHostConfig(portHTTP, portSSH)
 	networkConfig := docker.createNetworkConfig()
 	resp, err := docker.cli.ContainerCreate(
-		context.Background(), &container.Config{
-			Image: image,
-			Env: []string{
-				"ELASTICSEARCH_ENABLED=" +
-					docker.config.Bitbucket.ElasticSearchEnabled,
-				// "SERVER_PROXY_NAME=" +
-				// 	docker.config.Bitbucket.ServerProxyName,
-				"JVM_SUPPORT_RECOMMENDED_ARGS=" +
-					docker.config.Bitbucket.JvmSupportRecommendedArgs,
-			},
+		ctx, &container.Config{
+			Image:  image,
+			Labels: labels,
+			Env:    env,
 		}, hostConfig, networkConfig, name,
 	)
 	if err != nil {
+		countError("container_create")
+
 		return "", karma.Format(
 			err,
 			"unable to create container",
@@ -166,11 +268,40 @@ func (docker *Docker) CreateContainer(
 	return resp.ID, nil
 }
 
-func (docker *Docker) StartContainer(id string) error {
+// CopyToContainer extracts given tar archive into the path of container, the
+// container doesn't have to be started.
+func (docker *Docker) CopyToContainer(
+	ctx context.Context,
+	id, path string,
+	archive io.Reader,
+) error {
+	err := docker.cli.CopyToContainer(
+		ctx, id, path, archive,
+		types.CopyToContainerOptions{CopyUIDGID: true},
+	)
+	if err != nil {
+		countError("container_copy")
+
+		return karma.Format(
+			err,
+			"unable to copy archive to container, container_id: %s, path: %s",
+			id, path,
+		)
+	}
+
+	return nil
+}
+
+func (docker *Docker) StartContainer(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, docker.config.Timeouts.Start)
+	defer cancel()
+
 	err := docker.cli.ContainerStart(
-		context.Background(), id, types.ContainerStartOptions{},
+		ctx, id, types.ContainerStartOptions{},
 	)
 	if err != nil {
+		countError("container_start")
+
 		return karma.Format(
 			err,
 			"unable to start container",
@@ -180,9 +311,12 @@ func (docker *Docker) StartContainer(id string) error {
 	return nil
 }
 
-func (docker *Docker) RemoveContainers(ids []string) error {
+func (docker *Docker) RemoveContainers(
+	ctx context.Context,
+	ids []string,
+) error {
 	for _, id := range ids {
-		err := docker.RemoveContainer(id)
+		err := docker.RemoveContainer(ctx, id)
 		if err != nil {
 			return karma.Format(
 				err,
@@ -194,9 +328,9 @@ func (docker *Docker) RemoveContainers(ids []string) error {
 	return nil
 }
 
-func (docker *Docker) RemoveContainer(id string) error {
+func (docker *Docker) RemoveContainer(ctx context.Context, id string) error {
 	err := docker.cli.ContainerRemove(
-		context.Background(),
+		ctx,
 		id,
 		types.ContainerRemoveOptions{
 			RemoveVolumes: true,
@@ -205,6 +339,8 @@ func (docker *Docker) RemoveContainer(id string) error {
 		},
 	)
 	if err != nil {
+		countError("container_remove")
+
 		return karma.Format(
 			err,
 			"unable to remove container, container_id: %s",
@@ -215,9 +351,47 @@ func (docker *Docker) RemoveContainer(id string) error {
 	return nil
 }
 
-func (docker *Docker) StopContainer(id string) error {
-	err := docker.cli.ContainerStop(context.Background(), id, nil)
+func (docker *Docker) RenameContainer(
+	ctx context.Context,
+	id, name string,
+) error {
+	err := docker.cli.ContainerRename(ctx, id, name)
 	if err != nil {
+		countError("container_rename")
+
+		return karma.Format(
+			err,
+			"unable to rename container, container_id: %s, name: %s",
+			id, name,
+		)
+	}
+
+	return nil
+}
+
+func (docker *Docker) RemoveVolume(ctx context.Context, name string) error {
+	err := docker.cli.VolumeRemove(ctx, name, false)
+	if err != nil {
+		countError("volume_remove")
+
+		return karma.Format(
+			err,
+			"unable to remove volume, volume_name: %s",
+			name,
+		)
+	}
+
+	return nil
+}
+
+func (docker *Docker) StopContainer(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, docker.config.Timeouts.Stop)
+	defer cancel()
+
+	err := docker.cli.ContainerStop(ctx, id, nil)
+	if err != nil {
+		countError("container_stop")
+
 		return karma.Format(
 			err,
 			"unable to stop container, container_id: %s",
@@ -229,12 +403,15 @@ func (docker *Docker) StopContainer(id string) error {
 }
 
 func (docker *Docker) GetContainersListByPrefix(
+	ctx context.Context,
 	prefix string,
 ) ([]types.Container, error) {
 	containers, err := docker.cli.ContainerList(
-		context.Background(), types.ContainerListOptions{All: true},
+		ctx, types.ContainerListOptions{All: true},
 	)
 	if err != nil {
+		countError("container_list")
+
 		return nil, karma.Format(
 			err,
 			"unable to get container list by prefix: %s",
@@ -246,6 +423,7 @@ func (docker *Docker) GetContainersListByPrefix(
 		for _, name := range container.Names {
 			if strings.Contains(name, prefix) {
 				result = append(result, container)
+				break
 			}
 		}
 	}
@@ -253,11 +431,16 @@ func (docker *Docker) GetContainersListByPrefix(
 	return result, nil
 }
 
-func (docker *Docker) GetContainersByIDs(ids []string) ([]types.Container, error) {
+func (docker *Docker) GetContainersByIDs(
+	ctx context.Context,
+	ids []string,
+) ([]types.Container, error) {
 	containers, err := docker.cli.ContainerList(
-		context.Background(), types.ContainerListOptions{All: true},
+		ctx, types.ContainerListOptions{All: true},
 	)
 	if err != nil {
+		countError("container_list")
+
 		return nil, karma.Format(
 			err,
 			"unable to get container list",
@@ -269,6 +452,7 @@ func (docker *Docker) GetContainersByIDs(ids []string) ([]types.Container, error
 		for _, id := range ids {
 			if container.ID == id {
 				result = append(result, container)
+				break
 			}
 		}
 	}
@@ -276,12 +460,36 @@ func (docker *Docker) GetContainersByIDs(ids []string) ([]types.Container, error
 	return result, nil
 }
 
-func (docker *Docker) GetContainerByID(id string) (*types.Container, error) {
-	var result types.Container
+// GetContainerByID returns container by its ID, short ID or name, nil is
+// returned if there is no such container.
+func (docker *Docker) GetContainerByID(
+	ctx context.Context,
+	id string,
+) (*types.Container, error) {
+	inspect, err := docker.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+
+		countError("container_inspect")
+
+		return nil, karma.Format(
+			err,
+			"unable to inspect container, container_id: %s",
+			id,
+		)
+	}
+
 	containers, err := docker.cli.ContainerList(
-		context.Background(), types.ContainerListOptions{All: true},
+		ctx, types.ContainerListOptions{
+			All:     true,
+			Filters: filters.NewArgs(filters.Arg("id", inspect.ID)),
+		},
 	)
 	if err != nil {
+		countError("container_list")
+
 		return nil, karma.Format(
 			err,
 			"unable to get container list",
@@ -289,45 +497,50 @@ func (docker *Docker) GetContainerByID(id string) (*types.Container, error) {
 	}
 
 	for _, container := range containers {
-		if container.ID == id {
-			result = container
+		if container.ID == inspect.ID {
+			return &container, nil
 		}
 	}
 
-	return &result, nil
-}
-
-func setAllocatedStatus(name string) string {
-	return strings.Replace(
-		name, constants.NEW_CONTAINER_STATUS,
-		constants.ALLOCATED_CONTAINER_STATUS, 1,
-	)
+	// removed after it has been inspected
+	return nil, nil
 }
 
-func (docker *Docker) SetAllocatedStatusForContainer(
-	container types.Container,
-) error {
-	date := strings.Replace(
-		strings.Replace(
-			time.Now().Add(constants.CLEANING_INTERVAL).
-				Format(constants.TIME_FORMAT), " ", "--", -1,
-		), ":", ".", -1,
+func (docker *Docker) GetContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	containers, err := docker.cli.ContainerList(
+		ctx, types.ContainerListOptions{
+			All: true,
+			Filters: filters.NewArgs(
+				filters.Arg(
+					"label",
+					constants.LABEL_MANAGER+"="+docker.config.Prefix,
+				),
+			),
+		},
 	)
-	newName := setAllocatedStatus(container.Names[0]) + "--" + date
-	err := docker.cli.ContainerRename(context.Background(), container.ID, newName)
 	if err != nil {
-		return karma.Format(
+		countError("container_list")
+
+		return nil, karma.Format(
 			err,
-			"unable to rename container, container_id: %s",
-			container.ID,
+			"unable to get container list by label: %s",
+			constants.LABEL_MANAGER,
 		)
 	}
 
-	return nil
+	return containers, nil
 }
 
-func (docker *Docker) GetFreeContainers() ([]types.Container, error) {
-	containers, err := docker.GetContainersListByPrefix(docker.config.Prefix)
+// GetLegacyContainers returns containers created before labels were
+// introduced, such containers have their status encoded in the name.
+func (docker *Docker) GetLegacyContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	containers, err := docker.GetContainersListByPrefix(
+		ctx, docker.config.Prefix,
+	)
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -335,49 +548,39 @@ func (docker *Docker) GetFreeContainers() ([]types.Container, error) {
 		)
 	}
 
-	if len(containers) == 0 {
-		return nil, nil
-	}
-
 	var result []types.Container
 	for _, container := range containers {
-		if strings.Contains(container.Names[0], constants.NEW_CONTAINER_STATUS) {
-			result = append(result, container)
+		if _, ok := container.Labels[constants.LABEL_MANAGER]; ok {
+			continue
+		}
+
+		if !strings.Contains(container.Names[0], "---") {
+			continue
 		}
+
+		result = append(result, container)
 	}
 
 	return result, nil
 }
 
-func (docker *Docker) GetAllocatedContainers() ([]types.Container, error) {
-	containers, err := docker.GetContainersListByPrefix(docker.config.Prefix)
+func (docker *Docker) Ping(ctx context.Context) error {
+	_, err := docker.cli.Ping(ctx)
 	if err != nil {
-		return nil, karma.Format(
+		countError("ping")
+
+		return karma.Format(
 			err,
-			"unable to get container list",
+			"unable to ping docker daemon",
 		)
 	}
 
-	if len(containers) == 0 {
-		return nil, nil
-	}
-
-	var result []types.Container
-	for _, container := range containers {
-		if strings.Contains(
-			container.Names[0],
-			constants.ALLOCATED_CONTAINER_STATUS,
-		) {
-			result = append(result, container)
-		}
-	}
-
-	return result, nil
+	return nil
 }
 
-func (docker *Docker) CreateNetwork() error {
+func (docker *Docker) CreateNetwork(ctx context.Context) error {
 	log.Info("creating network")
-	result, err := docker.isDupNetwork(constants.DOCKER_NETWORK_NAME)
+	result, err := docker.isDupNetwork(ctx, constants.DOCKER_NETWORK_NAME)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -395,11 +598,18 @@ func (docker *Docker) CreateNetwork() error {
 	}
 
 	response, err := docker.cli.NetworkCreate(
-		context.Background(),
+		ctx,
 		constants.DOCKER_NETWORK_NAME,
-		types.NetworkCreate{Driver: "bridge"},
+		types.NetworkCreate{
+			Driver: "bridge",
+			Labels: map[string]string{
+				constants.LABEL_MANAGER: docker.config.Prefix,
+			},
+		},
 	)
 	if err != nil {
+		countError("network_create")
+
 		return karma.Format(
 			err,
 			"unable to create network",
@@ -414,9 +624,14 @@ func (docker *Docker) CreateNetwork() error {
 	return nil
 }
 
-func (docker *Docker) isDupNetwork(name string) (bool, error) {
-	networkList, err := docker.cli.NetworkList(context.Background(), types.NetworkListOptions{})
+func (docker *Docker) isDupNetwork(
+	ctx context.Context,
+	name string,
+) (bool, error) {
+	networkList, err := docker.cli.NetworkList(ctx, types.NetworkListOptions{})
 	if err != nil {
+		countError("network_list")
+
 		return false, karma.Format(
 			err,
 			"unable to get network list",
@@ -431,3 +646,8 @@ func (docker *Docker) isDupNetwork(name string) (bool, error) {
 
 	return false, nil
 }
+
+// countError counts failed calls of Docker API by operation.
+func countError(operation string) {
+	metrics.DockerErrors.WithLabelValues(operation).Inc()
+}
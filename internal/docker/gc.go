@@ -0,0 +1,204 @@
+package docker
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+// Orphan is a volume of this manager which is not used by any container,
+// it's removed once the grace period passes since it was found.
+type Orphan struct {
+	Kind     string    `json:"kind"`
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	FoundAt  time.Time `json:"foundAt"`
+	RemoveAt time.Time `json:"removeAt"`
+}
+
+// GarbageCollector periodically removes volumes left behind by removed or
+// crashed containers. The only network of the manager is shared by all
+// containers, so it's never collected.
+type GarbageCollector struct {
+	docker *Docker
+
+	mutex   sync.Mutex
+	orphans map[string]Orphan
+}
+
+func NewGarbageCollector(docker *Docker) *GarbageCollector {
+	return &GarbageCollector{
+		docker:  docker,
+		orphans: map[string]Orphan{},
+	}
+}
+
+// GetOrphans returns orphans found by the last collection.
+func (collector *GarbageCollector) GetOrphans() []Orphan {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	orphans := []Orphan{}
+	for _, orphan := range collector.orphans {
+		orphans = append(orphans, orphan)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].FoundAt.Before(orphans[j].FoundAt)
+	})
+
+	return orphans
+}
+
+// Collect finds orphans and removes ones found earlier than
+// gc.grace_period ago.
+func (collector *GarbageCollector) Collect(ctx context.Context) error {
+	found, err := collector.findOrphans(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	collector.mutex.Lock()
+	for key, orphan := range found {
+		if known, ok := collector.orphans[key]; ok {
+			found[key] = known
+			continue
+		}
+
+		log.Infof(
+			karma.Describe("kind", orphan.Kind).
+				Describe("remove_at", orphan.RemoveAt),
+			"orphan found: %s",
+			orphan.Name,
+		)
+	}
+
+	collector.orphans = found
+	collector.mutex.Unlock()
+
+	for key, orphan := range found {
+		if now.Before(orphan.RemoveAt) {
+			continue
+		}
+
+		if collector.docker.config.GC.DryRun {
+			log.Infof(
+				karma.Describe("kind", orphan.Kind),
+				"dry run, orphan would be removed: %s",
+				orphan.Name,
+			)
+			continue
+		}
+
+		err := collector.remove(ctx, orphan)
+		if err != nil {
+			log.Errorf(
+				err,
+				"unable to remove orphan: %s",
+				orphan.Name,
+			)
+			continue
+		}
+
+		log.Infof(
+			karma.Describe("kind", orphan.Kind),
+			"orphan removed: %s",
+			orphan.Name,
+		)
+
+		collector.mutex.Lock()
+		delete(collector.orphans, key)
+		collector.mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (collector *GarbageCollector) findOrphans(
+	ctx context.Context,
+) (map[string]Orphan, error) {
+	docker := collector.docker
+
+	containers, err := docker.cli.ContainerList(
+		ctx, types.ContainerListOptions{All: true},
+	)
+	if err != nil {
+		countError("container_list")
+
+		return nil, karma.Format(
+			err,
+			"unable to get container list",
+		)
+	}
+
+	volumes, err := docker.cli.VolumeList(ctx, filters.NewArgs())
+	if err != nil {
+		countError("volume_list")
+
+		return nil, karma.Format(
+			err,
+			"unable to get volume list",
+		)
+	}
+
+	return docker.getOrphanVolumes(containers, volumes.Volumes, time.Now()), nil
+}
+
+// getOrphanVolumes returns volumes of this manager which are not mounted by
+// any of given containers.
+func (docker *Docker) getOrphanVolumes(
+	containers []types.Container,
+	volumes []*types.Volume,
+	now time.Time,
+) map[string]Orphan {
+	used := map[string]bool{}
+	for _, container := range containers {
+		for _, point := range container.Mounts {
+			used[point.Name] = true
+		}
+	}
+
+	orphans := map[string]Orphan{}
+	for _, volume := range volumes {
+		if used[volume.Name] || !docker.isOwnVolume(volume) {
+			continue
+		}
+
+		orphans[constants.ORPHAN_KIND_VOLUME+"/"+volume.Name] = Orphan{
+			Kind:     constants.ORPHAN_KIND_VOLUME,
+			ID:       volume.Name,
+			Name:     volume.Name,
+			FoundAt:  now,
+			RemoveAt: now.Add(docker.config.GC.GracePeriod),
+		}
+	}
+
+	return orphans
+}
+
+// isOwnVolume returns true for volumes labeled by this manager and for
+// volumes created before volumes were labeled, which are recognized by name.
+func (docker *Docker) isOwnVolume(volume *types.Volume) bool {
+	if volume.Labels[constants.LABEL_MANAGER] == docker.config.Prefix {
+		return true
+	}
+
+	return strings.HasPrefix(volume.Name, docker.config.Prefix+"-volume-")
+}
+
+func (collector *GarbageCollector) remove(
+	ctx context.Context,
+	orphan Orphan,
+) error {
+	return collector.docker.RemoveVolume(ctx, orphan.ID)
+}
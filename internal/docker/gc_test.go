@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+func TestGetOrphanVolumes(t *testing.T) {
+	docker := &Docker{
+		config: &config.Config{
+			Prefix: "bitbucket-tests",
+			GC:     config.GC{GracePeriod: time.Hour},
+		},
+	}
+
+	containers := []types.Container{
+		{Mounts: []types.MountPoint{{Name: "bitbucket-tests-volume-1"}}},
+	}
+
+	volumes := []*types.Volume{
+		{Name: "bitbucket-tests-volume-1"},
+		{Name: "bitbucket-tests-volume-2"},
+		{
+			Name: "labeled",
+			Labels: map[string]string{
+				constants.LABEL_MANAGER: "bitbucket-tests",
+			},
+		},
+		{
+			Name: "other-manager",
+			Labels: map[string]string{
+				constants.LABEL_MANAGER: "other",
+			},
+		},
+		{Name: "unrelated"},
+	}
+
+	now := time.Now()
+	orphans := docker.getOrphanVolumes(containers, volumes, now)
+
+	tests := []struct {
+		name   string
+		orphan bool
+	}{
+		{"bitbucket-tests-volume-1", false},
+		{"bitbucket-tests-volume-2", true},
+		{"labeled", true},
+		{"other-manager", false},
+		{"unrelated", false},
+	}
+
+	for _, test := range tests {
+		orphan, ok := orphans[constants.ORPHAN_KIND_VOLUME+"/"+test.name]
+		if ok != test.orphan {
+			t.Errorf("%s: orphan = %v, want %v", test.name, ok, test.orphan)
+			continue
+		}
+
+		if ok && !orphan.RemoveAt.Equal(now.Add(time.Hour)) {
+			t.Errorf(
+				"%s: remove at %s, want after grace period",
+				test.name, orphan.RemoveAt,
+			)
+		}
+	}
+
+	if len(orphans) != 2 {
+		t.Errorf("orphans = %v, want 2", orphans)
+	}
+}
@@ -1,42 +1,142 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/reconquest/pkg/log"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/operator"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/supervisor"
 )
 
 type Handler struct {
-	config   *config.Config
-	operator *operator.Operator
+	config     *config.Config
+	operator   *operator.Operator
+	collector  *docker.GarbageCollector
+	supervisor *supervisor.Supervisor
+	metrics    http.Handler
+}
+
+type Status struct {
+	Workers []supervisor.Status `json:"workers"`
+}
+
+// ErrorResponse is the body of every error response, code is the kind of
+// the error, one of ERROR_KIND_* constants.
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func NewHandler(
 	config *config.Config,
 	operator *operator.Operator,
+	collector *docker.GarbageCollector,
+	supervisor *supervisor.Supervisor,
 ) *Handler {
 	return &Handler{
-		config:   config,
-		operator: operator,
+		config:     config,
+		operator:   operator,
+		collector:  collector,
+		supervisor: supervisor,
+		metrics:    promhttp.Handler(),
+	}
+}
+
+// GetMetrics serves metrics in Prometheus format, gauges of containers are
+// updated right before, other metrics are served even if it fails.
+func (handler *Handler) GetMetrics(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	err := handler.operator.UpdateMetrics(request.Context())
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to update metrics",
+		)
+	}
+
+	handler.metrics.ServeHTTP(writer, request)
+}
+
+func (handler *Handler) GetStatus(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	status := Status{
+		Workers: handler.supervisor.GetStatuses(),
+	}
+
+	err := json.NewEncoder(writer).Encode(status)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode status to json",
+		)
 	}
 }
 
 func (handler *Handler) GetAllContainers(
 	writer http.ResponseWriter, request *http.Request,
 ) {
-	containers, err := handler.operator.GetAllContaniersFromDocker()
+	query, err := getContainerQuery(request)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	containers, total, err := handler.operator.GetAllContaniersFromDocker(
+		request.Context(), query,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to get data from the docker",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	writer.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	err = json.NewEncoder(writer).Encode(containers)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode containers data to json",
+		)
+	}
+}
+
+func (handler *Handler) GetQuarantinedContainers(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	containers, err := handler.operator.GetQuarantinedContainers()
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to get data from the docker",
+			"unable to get quarantined containers",
 		)
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+
+		writeError(writer, err)
 		return
 	}
 
@@ -46,48 +146,128 @@ func (handler *Handler) GetAllContainers(
 			err,
 			"unable to encode containers data to json",
 		)
+	}
+}
+
+func (handler *Handler) GetOrphans(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	err := json.NewEncoder(writer).Encode(handler.collector.GetOrphans())
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode orphans data to json",
+		)
+	}
+}
+
+func (handler *Handler) Reconcile(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	results, err := handler.operator.Reconcile(request.Context())
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to reconcile containers",
+		)
 
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		writeError(writer, err)
 		return
 	}
+
+	err = json.NewEncoder(writer).Encode(results)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode reconcile results to json",
+		)
+	}
 }
 
 func (handler *Handler) GetFreeContainer(
 	writer http.ResponseWriter, request *http.Request,
 ) {
-	container, err := handler.operator.GetFreeContanier()
-	if err != nil && err != operator.ErrContainersAllocated {
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+	container, ticket, err := handler.allocateContainer(request)
+	if err != nil {
+		writeError(writer, err)
 		return
 	}
 
+	if ticket != nil {
+		writeTicket(writer, ticket)
+		return
+	}
+
+	err = json.NewEncoder(writer).Encode(container)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode container data to json",
+		)
+	}
+}
+
+// allocateContainer allocates a free container or provisions a new one,
+// with ?wait=<duration> the request is queued instead and the ticket is
+// returned if the request is still waiting when the duration passes.
+func (handler *Handler) allocateContainer(
+	request *http.Request,
+) (*operator.LeasedContainer, *operator.Ticket, error) {
+	version := request.URL.Query().Get("version")
+	profile := request.URL.Query().Get("profile")
+	owner := request.URL.Query().Get("owner")
+
+	ttl, err := getDuration(request, "ttl", handler.config.Lease.DefaultTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wait, err := getDuration(request, "wait", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if wait > 0 {
+		return handler.waitForContainer(
+			request.Context(), version, profile, owner, ttl, wait,
+		)
+	}
+
+	container, err := handler.operator.AllocateContainer(
+		request.Context(), version, profile, owner, ttl,
+	)
 	if err == operator.ErrContainersAllocated {
-		newContainer, err := handler.operator.CreateFreeContainer()
-		if err != nil {
+		container, err = handler.operator.CreateFreeContainer(
+			request.Context(), version, profile, owner, ttl,
+		)
+		if isServerError(err) {
 			log.Errorf(
 				err,
 				"unable to create free container",
 			)
-
-			fmt.Fprintln(writer, err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
 		}
+	}
+
+	return container, nil, err
+}
 
-		err = json.NewEncoder(writer).Encode(newContainer)
-		if err != nil {
+func (handler *Handler) GetContainerByID(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	containerID := vars["id"]
+	container, err := handler.operator.GetContainerByID(
+		request.Context(), containerID,
+	)
+	if err != nil {
+		if isServerError(err) {
 			log.Errorf(
 				err,
-				"unable to encode container data to json",
+				"unable to get container by id",
 			)
-
-			fmt.Fprintln(writer, err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
 		}
 
+		writeError(writer, err)
 		return
 	}
 
@@ -97,86 +277,617 @@ func (handler *Handler) GetFreeContainer(
 			err,
 			"unable to encode container data to json",
 		)
+	}
+}
 
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+func (handler *Handler) CreateContainer(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	version := request.URL.Query().Get("version")
+	profile := request.URL.Query().Get("profile")
+
+	job, err := handler.operator.StartJob(version, profile)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to start provisioning job",
+			)
+		}
+
+		writeError(writer, err)
 		return
 	}
+
+	writer.WriteHeader(http.StatusAccepted)
+
+	err = json.NewEncoder(writer).Encode(job)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode job data to json",
+		)
+	}
 }
 
-func (handler *Handler) GetContainerByID(
+func (handler *Handler) GetJobs(
 	writer http.ResponseWriter, request *http.Request,
 ) {
-	vars := mux.Vars(request)
-	containerID := vars["id"]
-	container, err := handler.operator.GetContainerByID(containerID)
+	err := json.NewEncoder(writer).Encode(handler.operator.GetJobs())
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to get container by id",
+			"unable to encode jobs data to json",
 		)
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (handler *Handler) GetJob(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	jobID := vars["id"]
 
+	job, err := handler.operator.GetJob(jobID)
+	if err != nil {
+		writeError(writer, err)
 		return
 	}
 
-	err = json.NewEncoder(writer).Encode(container)
+	err = json.NewEncoder(writer).Encode(job)
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to encode container data to json",
+			"unable to encode job data to json",
 		)
+	}
+}
 
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+func (handler *Handler) GetJobEvents(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	jobID := vars["id"]
+
+	subscription, err := handler.operator.SubscribeJob(jobID)
+	if err != nil {
+		writeError(writer, err)
 		return
 	}
+
+	streamEvents(writer, request, subscription)
 }
 
-func (handler *Handler) CreateContainer(
+func (handler *Handler) GetContainerEvents(
 	writer http.ResponseWriter, request *http.Request,
 ) {
-	container, err := handler.operator.HandleNewContainer()
+	vars := mux.Vars(request)
+	containerID := vars["id"]
+
+	subscription, err := handler.operator.SubscribeContainer(
+		request.Context(), containerID,
+	)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	streamEvents(writer, request, subscription)
+}
+
+// streamEvents writes events of the job as Server-Sent Events starting with
+// the current state of the job until the job is finished or the client
+// goes away.
+func streamEvents(
+	writer http.ResponseWriter,
+	request *http.Request,
+	subscription *operator.Subscription,
+) {
+	defer subscription.Close()
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, errors.New("streaming is not supported"))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+
+	last := operator.Event{
+		Type: constants.JOB_EVENT_STATE,
+		Job:  subscription.Job,
+	}
+
+	err := writeEvent(writer, last)
+	if err != nil {
+		return
+	}
+
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				if last.Type != constants.JOB_EVENT_FINISHED {
+					writeEvent(writer, operator.Event{
+						Type: constants.JOB_EVENT_FINISHED,
+						Job:  subscription.State(),
+					})
+					flusher.Flush()
+				}
+
+				return
+			}
+
+			err := writeEvent(writer, event)
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+
+			last = event
+
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(writer io.Writer, event operator.Event) error {
+	data, err := json.Marshal(event)
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to create and start container",
+			"unable to encode event data to json",
 		)
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
 
+	_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+func (handler *Handler) CancelJob(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	jobID := vars["id"]
+
+	job, err := handler.operator.CancelJob(jobID)
+	if err != nil {
+		writeError(writer, err)
 		return
 	}
 
-	err = json.NewEncoder(writer).Encode(container)
+	err = json.NewEncoder(writer).Encode(job)
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to encode containers data to json",
+			"unable to encode job data to json",
 		)
+	}
+}
 
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+func (handler *Handler) RemoveContainer(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	containerID := vars["id"]
+	err := handler.operator.RemoveContainerByID(request.Context(), containerID)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to remove container",
+			)
+		}
+
+		writeError(writer, err)
 		return
 	}
+
+	fmt.Fprintf(writer, "container successfully removed: %s", containerID)
 }
 
-func (handler *Handler) RemoveContainer(
+func (handler *Handler) RenewLease(
 	writer http.ResponseWriter, request *http.Request,
 ) {
 	vars := mux.Vars(request)
 	containerID := vars["id"]
-	err := handler.operator.RemoveContainerByID(containerID)
+
+	duration, err := getDuration(
+		request, "duration", handler.config.Lease.DefaultTTL,
+	)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	lease, err := handler.operator.RenewLease(
+		request.Context(), containerID, duration,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to renew lease",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	err = json.NewEncoder(writer).Encode(lease)
 	if err != nil {
 		log.Errorf(
 			err,
-			"unable to remove container",
+			"unable to encode lease data to json",
 		)
-		fmt.Fprintln(writer, err)
-		writer.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (handler *Handler) ReleaseContainer(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	containerID := vars["id"]
+
+	recycle := request.URL.Query().Get("recycle") == "true"
+
+	release, err := handler.operator.ReleaseContainer(
+		request.Context(), containerID, recycle,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to release container",
+			)
+		}
+
+		writeError(writer, err)
 		return
 	}
 
-	fmt.Fprintf(writer, "container successfully removed: %s", containerID)
+	err = json.NewEncoder(writer).Encode(release)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode release data to json",
+		)
+	}
+}
+
+func (handler *Handler) GetLeasesOfContainer(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	containerID := vars["id"]
+
+	leases, err := handler.operator.GetLeasesOfContainer(
+		request.Context(), containerID,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to get leases of container",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	err = json.NewEncoder(writer).Encode(leases)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode leases data to json",
+		)
+	}
+}
+
+// waitForContainer queues the allocation request and waits until it's
+// served, the ticket is returned if the request is still waiting when
+// timeout passes.
+func (handler *Handler) waitForContainer(
+	ctx context.Context,
+	version, profile, owner string,
+	ttl, wait time.Duration,
+) (*operator.LeasedContainer, *operator.Ticket, error) {
+	ticket, err := handler.operator.Enqueue(version, profile, owner, ttl)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to queue allocation request",
+			)
+		}
+
+		return nil, nil, err
+	}
+
+	ticket, err = handler.operator.WaitInQueue(ctx, ticket.ID, wait)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to wait for container",
+			)
+		}
+
+		return nil, nil, err
+	}
+
+	if ticket.Container == nil {
+		return nil, ticket, nil
+	}
+
+	return ticket.Container, nil, nil
+}
+
+func (handler *Handler) Enqueue(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	version := request.URL.Query().Get("version")
+	profile := request.URL.Query().Get("profile")
+	owner := request.URL.Query().Get("owner")
+
+	ttl, err := getDuration(request, "ttl", handler.config.Lease.DefaultTTL)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	ticket, err := handler.operator.Enqueue(version, profile, owner, ttl)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to queue allocation request",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	writeTicket(writer, ticket)
+}
+
+func (handler *Handler) GetTicket(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	ticketID := vars["id"]
+
+	wait, err := getDuration(request, "wait", 0)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	ticket, err := handler.operator.WaitInQueue(
+		request.Context(), ticketID, wait,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to wait for container",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	writeTicket(writer, ticket)
+}
+
+func (handler *Handler) CancelTicket(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	ticketID := vars["id"]
+
+	err := handler.operator.CancelTicket(request.Context(), ticketID)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	fmt.Fprintf(writer, "ticket successfully cancelled: %s", ticketID)
+}
+
+// writeTicket responds with 200 OK if the ticket is served and with
+// 202 Accepted if it's still waiting in the queue.
+func writeTicket(writer http.ResponseWriter, ticket *operator.Ticket) {
+	if ticket.Container == nil {
+		writer.WriteHeader(http.StatusAccepted)
+	}
+
+	err := json.NewEncoder(writer).Encode(ticket)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode ticket data to json",
+		)
+	}
+}
+
+func getDuration(
+	request *http.Request,
+	name string,
+	defaultValue time.Duration,
+) (time.Duration, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, operator.NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			fmt.Sprintf("%s: %s", name, err),
+		)
+	}
+
+	if duration <= 0 {
+		return 0, operator.NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			name+" must be positive",
+		)
+	}
+
+	return duration, nil
+}
+
+// getAge returns the age filter, unlike getDuration zero is allowed and
+// means no filter.
+func getAge(request *http.Request, name string) (time.Duration, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, operator.NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			fmt.Sprintf("%s: %s", name, err),
+		)
+	}
+
+	if age < 0 {
+		return 0, operator.NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			name+" must not be negative",
+		)
+	}
+
+	return age, nil
+}
+
+// getContainerQuery returns query of containers listing, state may be
+// repeated or contain comma-separated states.
+func getContainerQuery(
+	request *http.Request,
+) (operator.ContainerQuery, error) {
+	values := request.URL.Query()
+
+	query := operator.ContainerQuery{
+		Version: values.Get("version"),
+		Owner:   values.Get("owner"),
+		Sort:    values.Get("sort"),
+		Order:   values.Get("order"),
+	}
+
+	for _, value := range values["state"] {
+		for _, state := range strings.Split(value, ",") {
+			if state != "" {
+				query.States = append(query.States, state)
+			}
+		}
+	}
+
+	var err error
+
+	query.MinAge, err = getAge(request, "min_age")
+	if err != nil {
+		return query, err
+	}
+
+	query.MaxAge, err = getAge(request, "max_age")
+	if err != nil {
+		return query, err
+	}
+
+	query.Offset, err = getInt(request, "offset")
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit, err = getInt(request, "limit")
+	if err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+func getInt(request *http.Request, name string) (int, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, operator.NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			fmt.Sprintf("%s: %s", name, err),
+		)
+	}
+
+	return number, nil
+}
+
+// isServerError returns true if err is not caused by the request, so it
+// should be logged.
+func isServerError(err error) bool {
+	switch operator.GetErrorKind(err) {
+	case constants.ERROR_KIND_INTERNAL, constants.ERROR_KIND_PROVISIONING_FAILED:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeError responds with the error envelope, status code is chosen by
+// kind of the error.
+func writeError(writer http.ResponseWriter, err error) {
+	kind := operator.GetErrorKind(err)
+
+	var status int
+	switch kind {
+	case constants.ERROR_KIND_NOT_FOUND:
+		status = http.StatusNotFound
+	case constants.ERROR_KIND_INVALID_INPUT:
+		status = http.StatusBadRequest
+	case constants.ERROR_KIND_CONFLICT:
+		status = http.StatusConflict
+	case constants.ERROR_KIND_CAPACITY_EXHAUSTED,
+		constants.ERROR_KIND_UNAVAILABLE:
+		status = http.StatusServiceUnavailable
+	case constants.ERROR_KIND_PROVISIONING_FAILED:
+		status = http.StatusBadGateway
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	response := ErrorResponse{
+		Error: Error{
+			Code:    kind,
+			Message: err.Error(),
+		},
+	}
+
+	err = json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode error to json",
+		)
+	}
 }
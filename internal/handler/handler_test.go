@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/operator"
+)
+
+func TestGetContainerQuery(t *testing.T) {
+	tests := []struct {
+		url   string
+		query operator.ContainerQuery
+		err   bool
+	}{
+		{
+			url:   "/container/all",
+			query: operator.ContainerQuery{},
+		},
+		{
+			url: "/container/all?state=free,leased&state=failed&owner=ci" +
+				"&version=6.8.0&sort=expires&order=desc&offset=10&limit=5",
+			query: operator.ContainerQuery{
+				States:  []string{"free", "leased", "failed"},
+				Version: "6.8.0",
+				Owner:   "ci",
+				Sort:    "expires",
+				Order:   "desc",
+				Offset:  10,
+				Limit:   5,
+			},
+		},
+		{
+			url: "/container/all?min_age=1h&max_age=2h",
+			query: operator.ContainerQuery{
+				MinAge: time.Hour,
+				MaxAge: 2 * time.Hour,
+			},
+		},
+		{
+			url:   "/container/all?min_age=0&max_age=0",
+			query: operator.ContainerQuery{},
+		},
+		{
+			url:   "/container/all?min_age=0s&max_age=1h",
+			query: operator.ContainerQuery{MaxAge: time.Hour},
+		},
+		{url: "/container/all?min_age=-1h", err: true},
+		{url: "/container/all?max_age=hour", err: true},
+		{url: "/container/all?limit=ten", err: true},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.url, nil)
+
+		query, err := getContainerQuery(request)
+		if test.err {
+			if operator.GetErrorKind(err) != constants.ERROR_KIND_INVALID_INPUT {
+				t.Errorf("%s: error = %v, want invalid input", test.url, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.url, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(query, test.query) {
+			t.Errorf("%s: query = %+v, want %+v", test.url, query, test.query)
+		}
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	tests := []struct {
+		url      string
+		duration time.Duration
+		err      bool
+	}{
+		{url: "/container", duration: time.Minute},
+		{url: "/container?ttl=2h", duration: 2 * time.Hour},
+		{url: "/container?ttl=0", err: true},
+		{url: "/container?ttl=-1m", err: true},
+		{url: "/container?ttl=forever", err: true},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.url, nil)
+
+		duration, err := getDuration(request, "ttl", time.Minute)
+		if test.err {
+			if operator.GetErrorKind(err) != constants.ERROR_KIND_INVALID_INPUT {
+				t.Errorf("%s: error = %v, want invalid input", test.url, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.url, err)
+			continue
+		}
+
+		if duration != test.duration {
+			t.Errorf(
+				"%s: duration = %s, want %s",
+				test.url, duration, test.duration,
+			)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+		server bool
+	}{
+		{
+			operator.NewError(constants.ERROR_KIND_NOT_FOUND, "not found"),
+			http.StatusNotFound, constants.ERROR_KIND_NOT_FOUND, false,
+		},
+		{
+			operator.NewError(constants.ERROR_KIND_INVALID_INPUT, "invalid"),
+			http.StatusBadRequest, constants.ERROR_KIND_INVALID_INPUT, false,
+		},
+		{
+			operator.NewError(constants.ERROR_KIND_CONFLICT, "conflict"),
+			http.StatusConflict, constants.ERROR_KIND_CONFLICT, false,
+		},
+		{
+			karma.Describe("container_id", "abc").
+				Reason(operator.ErrContainerNotFound),
+			http.StatusNotFound, constants.ERROR_KIND_NOT_FOUND, false,
+		},
+		{
+			operator.ErrContainerNotAllocated,
+			http.StatusConflict, constants.ERROR_KIND_CONFLICT, false,
+		},
+		{
+			operator.NewError(constants.ERROR_KIND_CAPACITY_EXHAUSTED, "full"),
+			http.StatusServiceUnavailable,
+			constants.ERROR_KIND_CAPACITY_EXHAUSTED, false,
+		},
+		{
+			operator.NewError(constants.ERROR_KIND_UNAVAILABLE, "draining"),
+			http.StatusServiceUnavailable,
+			constants.ERROR_KIND_UNAVAILABLE, false,
+		},
+		{
+			karma.Format(operator.ErrProvisioningFailed, "unable to start"),
+			http.StatusBadGateway,
+			constants.ERROR_KIND_PROVISIONING_FAILED, true,
+		},
+		{
+			errors.New("boom"),
+			http.StatusInternalServerError,
+			constants.ERROR_KIND_INTERNAL, true,
+		},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		writeError(recorder, test.err)
+
+		if recorder.Code != test.status {
+			t.Errorf(
+				"%s: status = %d, want %d",
+				test.code, recorder.Code, test.status,
+			)
+		}
+
+		if isServerError(test.err) != test.server {
+			t.Errorf(
+				"%s: server error = %v, want %v",
+				test.code, !test.server, test.server,
+			)
+		}
+
+		var response ErrorResponse
+		err := json.NewDecoder(recorder.Body).Decode(&response)
+		if err != nil {
+			t.Errorf("%s: unable to decode response: %s", test.code, err)
+			continue
+		}
+
+		if response.Error.Code != test.code ||
+			response.Error.Message != test.err.Error() {
+			t.Errorf("%s: response = %+v", test.code, response)
+		}
+	}
+}
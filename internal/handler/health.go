@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+// Check is a single check of health or readiness of the manager, error is
+// set if the check has failed.
+type Check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Health struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks"`
+}
+
+// GetHealth reports whether the manager is alive and its dependencies are
+// reachable, it responds with 503 if any check fails.
+func (handler *Handler) GetHealth(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	ctx, cancel := context.WithTimeout(
+		request.Context(), handler.config.Timeouts.Request,
+	)
+	defer cancel()
+
+	writeHealth(writer, []Check{
+		newCheck("process", nil),
+		newCheck("docker", handler.operator.CheckDocker(ctx)),
+		newCheck("database", handler.operator.CheckDatabase(ctx)),
+	})
+}
+
+// GetReadiness reports whether the manager is ready to serve allocations,
+// it responds with 503 if any check fails.
+func (handler *Handler) GetReadiness(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	ctx, cancel := context.WithTimeout(
+		request.Context(), handler.config.Timeouts.Request,
+	)
+	defer cancel()
+
+	writeHealth(writer, []Check{
+		newCheck("network", handler.operator.CheckNetwork()),
+		newCheck("reconcile", handler.operator.CheckReconciled()),
+		newCheck("pool", handler.operator.CheckPool(ctx)),
+		newCheck("cleaner", handler.checkWorker("cleaner")),
+	})
+}
+
+// checkWorker returns error if the worker isn't started or its last run
+// has failed.
+func (handler *Handler) checkWorker(name string) error {
+	status, ok := handler.supervisor.GetStatus(name)
+	if !ok {
+		return errors.New("worker is not started")
+	}
+
+	if status.ConsecutiveErrors > 0 {
+		return karma.Describe("consecutive_errors", status.ConsecutiveErrors).
+			Reason(status.LastError)
+	}
+
+	return nil
+}
+
+func newCheck(name string, err error) Check {
+	check := Check{
+		Name: name,
+		OK:   err == nil,
+	}
+
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+func writeHealth(writer http.ResponseWriter, checks []Check) {
+	health := Health{
+		OK:     true,
+		Checks: checks,
+	}
+
+	for _, check := range checks {
+		if !check.OK {
+			health.OK = false
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !health.OK {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	err := json.NewEncoder(writer).Encode(health)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode health to json",
+		)
+	}
+}
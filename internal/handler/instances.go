@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/reconquest/pkg/log"
+)
+
+// GetInstances serves API v2 counterpart of GetAllContainers.
+func (handler *Handler) GetInstances(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	query, err := getContainerQuery(request)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	instances, total, err := handler.operator.GetInstances(
+		request.Context(), query,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to get instances",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	writer.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	err = json.NewEncoder(writer).Encode(instances)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode instances data to json",
+		)
+	}
+}
+
+// GetInstance serves API v2 counterpart of GetContainerByID.
+func (handler *Handler) GetInstance(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	vars := mux.Vars(request)
+	instanceID := vars["id"]
+
+	instance, err := handler.operator.GetInstance(
+		request.Context(), instanceID,
+	)
+	if err != nil {
+		if isServerError(err) {
+			log.Errorf(
+				err,
+				"unable to get instance by id",
+			)
+		}
+
+		writeError(writer, err)
+		return
+	}
+
+	err = json.NewEncoder(writer).Encode(instance)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode instance data to json",
+		)
+	}
+}
+
+// GetFreeInstance serves API v2 counterpart of GetFreeContainer, it accepts
+// the same parameters.
+func (handler *Handler) GetFreeInstance(
+	writer http.ResponseWriter, request *http.Request,
+) {
+	container, ticket, err := handler.allocateContainer(request)
+	if err != nil {
+		writeError(writer, err)
+		return
+	}
+
+	if ticket != nil {
+		writeTicket(writer, ticket)
+		return
+	}
+
+	instance := handler.operator.GetInstanceOfContainer(
+		container.Container,
+	)
+
+	err = json.NewEncoder(writer).Encode(instance)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to encode instance data to json",
+		)
+	}
+}
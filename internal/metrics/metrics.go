@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "bitbucket_pool_manager"
+
+var (
+	// Containers is updated on every scrape by the operator.
+	Containers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "containers",
+			Help:      "Number of containers by pool and state.",
+		},
+		[]string{"pool", "state"},
+	)
+
+	QueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "queue_length",
+			Help:      "Number of allocation requests waiting in the queue.",
+		},
+	)
+
+	AllocationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "allocation_duration_seconds",
+			Help:      "Time taken to allocate a container by source.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		},
+		[]string{"pool", "source"},
+	)
+
+	ProvisioningDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "provisioning_phase_duration_seconds",
+			Help:      "Time spent by provisioning jobs in every phase.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 13),
+		},
+		[]string{"pool", "phase"},
+	)
+
+	ProvisioningJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "provisioning_jobs_total",
+			Help:      "Number of finished provisioning jobs by result.",
+		},
+		[]string{"pool", "result"},
+	)
+
+	CleanerRuns = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_runs_total",
+			Help:      "Number of runs of the cleaner of expired leases.",
+		},
+	)
+
+	CleanerRemovals = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_removed_containers_total",
+			Help:      "Number of containers removed by the cleaner.",
+		},
+	)
+
+	DockerErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "docker_errors_total",
+			Help:      "Number of failed calls of Docker API by operation.",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		Containers,
+		QueueLength,
+		AllocationDuration,
+		ProvisioningDuration,
+		ProvisioningJobs,
+		CleanerRuns,
+		CleanerRemovals,
+		DockerErrors,
+	)
+}
@@ -0,0 +1,62 @@
+package operator
+
+import (
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+// Error is an error of the operator classified by kind, so it's reported to
+// clients with the proper status code. Errors which are not classified are
+// internal ones.
+type Error struct {
+	Kind    string
+	Message string
+}
+
+// ErrProvisioningFailed is added to reasons of errors of failed
+// provisioning.
+var ErrProvisioningFailed = NewError(
+	constants.ERROR_KIND_PROVISIONING_FAILED,
+	"provisioning has failed",
+)
+
+// NewError returns error of given kind, kinds are ERROR_KIND_* constants.
+func NewError(kind string, message string) *Error {
+	return &Error{
+		Kind:    kind,
+		Message: message,
+	}
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// GetErrorKind returns kind of the first classified error in the chain of
+// reasons of given error.
+func GetErrorKind(err error) string {
+	typed := findError(err)
+	if typed == nil {
+		return constants.ERROR_KIND_INTERNAL
+	}
+
+	return typed.Kind
+}
+
+func findError(reason karma.Reason) *Error {
+	switch reason := reason.(type) {
+	case *Error:
+		return reason
+	case karma.Karma:
+		for _, nested := range reason.GetReasons() {
+			typed := findError(nested)
+			if typed != nil {
+				return typed
+			}
+		}
+	case *karma.Karma:
+		return findError(*reason)
+	}
+
+	return nil
+}
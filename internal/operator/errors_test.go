@@ -0,0 +1,68 @@
+package operator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+func TestGetErrorKind(t *testing.T) {
+	notFound := NewError(constants.ERROR_KIND_NOT_FOUND, "not found")
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"nil", nil, constants.ERROR_KIND_INTERNAL},
+		{"plain", errors.New("boom"), constants.ERROR_KIND_INTERNAL},
+		{"typed", notFound, constants.ERROR_KIND_NOT_FOUND},
+		{
+			"formatted",
+			karma.Format(notFound, "unable to get container"),
+			constants.ERROR_KIND_NOT_FOUND,
+		},
+		{
+			"described",
+			karma.Describe("id", "abc").Reason(notFound),
+			constants.ERROR_KIND_NOT_FOUND,
+		},
+		{
+			"nested",
+			karma.Format(
+				karma.Format(ErrProvisioningFailed, "unable to start"),
+				"unable to provision",
+			),
+			constants.ERROR_KIND_PROVISIONING_FAILED,
+		},
+		{
+			"pushed",
+			karma.Push(errors.New("boom"), ErrProvisioningFailed),
+			constants.ERROR_KIND_PROVISIONING_FAILED,
+		},
+		{
+			"unknown container",
+			karma.Describe("container_id", "abc").Reason(ErrContainerNotFound),
+			constants.ERROR_KIND_NOT_FOUND,
+		},
+		{
+			"container is not allocated",
+			ErrContainerNotAllocated,
+			constants.ERROR_KIND_CONFLICT,
+		},
+		{
+			"formatted plain",
+			karma.Format(errors.New("boom"), "unable to list"),
+			constants.ERROR_KIND_INTERNAL,
+		},
+	}
+
+	for _, test := range tests {
+		kind := GetErrorKind(test.err)
+		if kind != test.expected {
+			t.Errorf("%s: kind = %q, want %q", test.name, kind, test.expected)
+		}
+	}
+}
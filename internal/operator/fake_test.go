@@ -0,0 +1,371 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/options"
+)
+
+const testPrefix = "bitbucket-tests"
+
+func TestMain(m *testing.M) {
+	// the colored formatter of the logger isn't safe for concurrent use,
+	// which is reported by the race detector when containers are handled in
+	// parallel, so tests log nothing but fatal errors
+	log.SetLevel(log.LevelFatal)
+
+	os.Exit(m.Run())
+}
+
+type fakeDocker struct {
+	mutex      sync.Mutex
+	containers map[string]types.Container
+	stopped    []string
+	removed    []string
+	volumes    []string
+	created    int
+
+	// startErr is returned by StartContainer if set
+	startErr error
+
+	// onList is called every time containers are listed
+	onList func()
+	// onGetByIDs is called every time containers are requested by ids
+	onGetByIDs func()
+	// onCreate is called every time a container is created
+	onCreate func()
+	// onRemove is called every time a container is removed
+	onRemove func()
+}
+
+func newFakeDocker(containers ...types.Container) *fakeDocker {
+	fake := &fakeDocker{containers: map[string]types.Container{}}
+	for _, container := range containers {
+		fake.containers[container.ID] = container
+	}
+
+	return fake
+}
+
+func newTestContainer(id string, status string, created int64) types.Container {
+	return types.Container{
+		ID:      id,
+		Names:   []string{"/" + testPrefix + "-" + id},
+		Image:   "atlassian/bitbucket-server:6.8.0",
+		Status:  status,
+		Created: created,
+		Labels: map[string]string{
+			constants.LABEL_MANAGER: testPrefix,
+			constants.LABEL_POOL:    "6.8.0",
+		},
+	}
+}
+
+func (fake *fakeDocker) PullImage(
+	ctx context.Context,
+	image string,
+	progress func(docker.PullProgress),
+) error {
+	return nil
+}
+
+func (fake *fakeDocker) CreateContainer(
+	ctx context.Context,
+	name, image, portHTTP, portSSH string,
+	env []string,
+	labels map[string]string,
+) (string, error) {
+	if fake.onCreate != nil {
+		fake.onCreate()
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.created++
+
+	id := fmt.Sprintf("created%d", fake.created)
+	fake.containers[id] = types.Container{
+		ID:     id,
+		Names:  []string{"/" + name},
+		Image:  image,
+		Status: "Created",
+		Labels: labels,
+	}
+
+	return id, nil
+}
+
+func (fake *fakeDocker) CopyToContainer(
+	ctx context.Context,
+	id, path string,
+	archive io.Reader,
+) error {
+	return nil
+}
+
+func (fake *fakeDocker) StartContainer(ctx context.Context, id string) error {
+	return fake.startErr
+}
+
+func (fake *fakeDocker) RemoveContainer(ctx context.Context, id string) error {
+	if fake.onRemove != nil {
+		fake.onRemove()
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	delete(fake.containers, id)
+	fake.removed = append(fake.removed, id)
+
+	return nil
+}
+
+func (fake *fakeDocker) RenameContainer(
+	ctx context.Context,
+	id, name string,
+) error {
+	return nil
+}
+
+func (fake *fakeDocker) RemoveVolume(ctx context.Context, name string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.volumes = append(fake.volumes, name)
+
+	return nil
+}
+
+func (fake *fakeDocker) StopContainer(ctx context.Context, id string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.stopped = append(fake.stopped, id)
+
+	return nil
+}
+
+func (fake *fakeDocker) GetContainersListByPrefix(
+	ctx context.Context,
+	prefix string,
+) ([]types.Container, error) {
+	return nil, nil
+}
+
+func (fake *fakeDocker) GetContainersByIDs(
+	ctx context.Context,
+	ids []string,
+) ([]types.Container, error) {
+	if fake.onGetByIDs != nil {
+		fake.onGetByIDs()
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	var result []types.Container
+	for _, id := range ids {
+		if container, ok := fake.containers[id]; ok {
+			result = append(result, container)
+		}
+	}
+
+	return result, nil
+}
+
+func (fake *fakeDocker) GetContainerByID(
+	ctx context.Context,
+	id string,
+) (*types.Container, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	container, ok := fake.containers[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &container, nil
+}
+
+func (fake *fakeDocker) GetContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	if fake.onList != nil {
+		fake.onList()
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	result := []types.Container{}
+	for _, container := range fake.containers {
+		result = append(result, container)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+func (fake *fakeDocker) GetLegacyContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	return nil, nil
+}
+
+func (fake *fakeDocker) CreateNetwork(ctx context.Context) error {
+	return nil
+}
+
+func (fake *fakeDocker) Ping(ctx context.Context) error {
+	return nil
+}
+
+type fakeDatabase struct {
+	mutex        sync.Mutex
+	leases       map[string]database.Lease
+	saveLeaseErr error
+}
+
+func newFakeDatabase() *fakeDatabase {
+	return &fakeDatabase{leases: map[string]database.Lease{}}
+}
+
+func (fake *fakeDatabase) SaveContainer(container docker.ContainerData) error {
+	return nil
+}
+
+func (fake *fakeDatabase) SetContainerAllocation(
+	id string,
+	isAllocated bool,
+	allocatedTime time.Time,
+) error {
+	return nil
+}
+
+func (fake *fakeDatabase) RemoveContainer(id string, removedAt time.Time) error {
+	return nil
+}
+
+func (fake *fakeDatabase) QuarantineContainer(
+	id string,
+	reason string,
+	quarantinedAt time.Time,
+) error {
+	return nil
+}
+
+func (fake *fakeDatabase) SetContainerAddonVersion(
+	id string,
+	version string,
+) error {
+	return nil
+}
+
+func (fake *fakeDatabase) GetContainers() ([]docker.ContainerData, error) {
+	return nil, nil
+}
+
+func (fake *fakeDatabase) SaveLease(lease database.Lease) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if fake.saveLeaseErr != nil {
+		return fake.saveLeaseErr
+	}
+
+	fake.leases[lease.ID] = lease
+
+	return nil
+}
+
+func (fake *fakeDatabase) GetActiveLeases() ([]database.Lease, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	var result []database.Lease
+	for _, lease := range fake.leases {
+		if lease.ReleasedAt == nil {
+			result = append(result, lease)
+		}
+	}
+
+	return result, nil
+}
+
+func (fake *fakeDatabase) GetLeasesByContainerID(
+	id string,
+) ([]database.Lease, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	var result []database.Lease
+	for _, lease := range fake.leases {
+		if lease.ContainerID == id {
+			result = append(result, lease)
+		}
+	}
+
+	return result, nil
+}
+
+func (fake *fakeDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+func newTestConfig() *config.Config {
+	return &config.Config{
+		Prefix: testPrefix,
+		Bitbucket: config.Bitbucket{
+			URL:     "bitbucket.local",
+			Version: "6.8.0",
+		},
+		Lease: config.Lease{
+			DefaultTTL: time.Hour,
+			MaxTTL:     4 * time.Hour,
+		},
+		Pool: config.Pool{
+			MinFree:  0,
+			MaxTotal: 6,
+		},
+		Pools: []config.BitbucketPool{
+			{Version: "6.8.0", MaxTotal: 6},
+			{Version: "7.6.0", MaxTotal: 6},
+		},
+		Queue: config.Queue{
+			Timeout: time.Minute,
+		},
+		Provisioning: config.Provisioning{
+			Concurrency:    2,
+			StartupTimeout: time.Minute,
+		},
+		Timeouts: config.Timeouts{
+			Request: time.Second,
+		},
+	}
+}
+
+func newTestOperator(
+	docker *fakeDocker,
+	database *fakeDatabase,
+) *Operator {
+	return NewOperator(newTestConfig(), docker, database, options.DocoptOptions{})
+}
@@ -0,0 +1,102 @@
+package operator
+
+import (
+	"context"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+var (
+	ErrNetworkNotCreated = NewError(
+		constants.ERROR_KIND_UNAVAILABLE,
+		"network is not created yet",
+	)
+	ErrPoolNotFilled = NewError(
+		constants.ERROR_KIND_UNAVAILABLE,
+		"pool is not filled yet",
+	)
+	ErrNotReconciled = NewError(
+		constants.ERROR_KIND_UNAVAILABLE,
+		"containers are not reconciled yet",
+	)
+)
+
+func (operator *Operator) CheckDocker(ctx context.Context) error {
+	return operator.docker.Ping(ctx)
+}
+
+func (operator *Operator) CheckDatabase(ctx context.Context) error {
+	return operator.database.Ping(ctx)
+}
+
+func (operator *Operator) CheckNetwork() error {
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if !operator.networkCreated {
+		return ErrNetworkNotCreated
+	}
+
+	return nil
+}
+
+func (operator *Operator) CheckReconciled() error {
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if !operator.reconciled {
+		return ErrNotReconciled
+	}
+
+	return nil
+}
+
+// CheckPool returns error until every pool is filled with free containers
+// for the first time since start, the pool isn't checked anymore afterwards,
+// so allocations don't make the manager unready. Error is returned once the
+// operator is draining.
+func (operator *Operator) CheckPool(ctx context.Context) error {
+	version, missing, err := operator.getMissingContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get number of missing free containers",
+		)
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if operator.draining {
+		return ErrShuttingDown
+	}
+
+	if operator.poolFilled {
+		return nil
+	}
+
+	if missing > 0 {
+		return karma.Describe("version", version).
+			Describe("missing", missing).
+			Reason(ErrPoolNotFilled)
+	}
+
+	// containers being provisioned are counted as free ones by
+	// getMissingContainers
+	provisioning := 0
+	for _, container := range operator.provisioning {
+		if container.profile == "" && container.lease == nil {
+			provisioning++
+		}
+	}
+
+	if provisioning > 0 {
+		return karma.Describe("provisioning", provisioning).
+			Reason(ErrPoolNotFilled)
+	}
+
+	operator.poolFilled = true
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+)
+
+// Instance is a Bitbucket instance served by API v2, unlike containers of
+// API v1 it doesn't expose Docker internals.
+type Instance struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	State        string         `json:"state"`
+	Version      string         `json:"version"`
+	Profile      string         `json:"profile,omitempty"`
+	Image        string         `json:"image"`
+	AddonKey     string         `json:"addonKey,omitempty"`
+	AddonVersion string         `json:"addonVersion,omitempty"`
+	URLs         InstanceURLs   `json:"urls"`
+	Credentials  Credentials    `json:"credentials"`
+	Lease        *InstanceLease `json:"lease,omitempty"`
+	CreatedAt    time.Time      `json:"createdAt"`
+}
+
+// InstanceURLs are URLs of the instance, clone is the prefix of HTTP clone
+// URLs of repositories, which are <clone>/<project>/<repository>.git.
+type InstanceURLs struct {
+	HTTP  string `json:"http"`
+	SSH   string `json:"ssh"`
+	Clone string `json:"clone"`
+}
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type InstanceLease struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// GetInstances returns the requested page of instances of this manager
+// including quarantined ones, and the number of instances matching the query.
+func (operator *Operator) GetInstances(
+	ctx context.Context,
+	query ContainerQuery,
+) ([]Instance, int, error) {
+	containers, total, err := operator.queryContainers(ctx, query)
+	if err != nil {
+		return nil, 0, karma.Format(
+			err,
+			"unable to query containers",
+		)
+	}
+
+	records, err := operator.getContainerRecords()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	instances := []Instance{}
+	for _, container := range containers {
+		instances = append(
+			instances,
+			operator.getInstance(container, records[container.ID]),
+		)
+	}
+
+	return instances, total, nil
+}
+
+func (operator *Operator) GetInstance(
+	ctx context.Context,
+	id string,
+) (*Instance, error) {
+	container, err := operator.getContainer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := operator.getContainerRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	instance := operator.getInstance(*container, records[container.ID])
+
+	return &instance, nil
+}
+
+// GetInstanceOfContainer returns instance of the container which is
+// already retrieved from docker, addon version is omitted if records of
+// containers can't be retrieved.
+func (operator *Operator) GetInstanceOfContainer(
+	container types.Container,
+) Instance {
+	records, err := operator.getContainerRecords()
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to get addon version, container_id: %s",
+			container.ID,
+		)
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	return operator.getInstance(container, records[container.ID])
+}
+
+// getInstance must be called with operator.mutex held.
+func (operator *Operator) getInstance(
+	container types.Container,
+	record docker.ContainerData,
+) Instance {
+	data := operator.getContainerData(container)
+
+	instance := Instance{
+		ID:           container.ID,
+		Name:         data.Name,
+		State:        operator.getContainerState(container),
+		Version:      data.Pool,
+		Profile:      data.Profile,
+		Image:        data.Image,
+		AddonVersion: record.AddonVersion,
+		URLs: InstanceURLs{
+			HTTP: operator.GetURI("", data.PortHTTP),
+			SSH: fmt.Sprintf(
+				"ssh://git@%s:%s", operator.config.Bitbucket.URL, data.PortSSH,
+			),
+			Clone: operator.GetURI("/scm", data.PortHTTP),
+		},
+		Credentials: Credentials{
+			Username: data.Username,
+			Password: data.Password,
+		},
+		CreatedAt: data.Date,
+	}
+
+	profile, err := operator.getProfile(data.Profile)
+	if err == nil {
+		instance.AddonKey = profile.AddonKey
+	}
+
+	lease := operator.getLeaseByContainerID(container.ID)
+	if lease != nil {
+		instance.Lease = &InstanceLease{
+			ID:        lease.ID,
+			Owner:     lease.Owner,
+			ExpiresAt: lease.ExpiresAt,
+		}
+	}
+
+	return instance
+}
+
+// getContainerState must be called with operator.mutex held.
+func (operator *Operator) getContainerState(container types.Container) string {
+	switch {
+	case isQuarantined(container):
+		return constants.CONTAINER_STATE_FAILED
+	case operator.isProvisioning(container):
+		return constants.CONTAINER_STATE_PROVISIONING
+	case operator.getLeaseByContainerID(container.ID) != nil:
+		return constants.CONTAINER_STATE_LEASED
+	case handleStatusOfContainer(container.Status) !=
+		constants.CONTAINER_STATUS_UP:
+		return constants.CONTAINER_STATE_STOPPED
+	default:
+		return constants.CONTAINER_STATE_FREE
+	}
+}
+
+// getContainerRecords returns records of containers which are not removed
+// by container id.
+func (operator *Operator) getContainerRecords() (
+	map[string]docker.ContainerData,
+	error,
+) {
+	records, err := operator.database.GetContainers()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get containers from database",
+		)
+	}
+
+	result := map[string]docker.ContainerData{}
+	for _, record := range records {
+		result[record.ID] = record
+	}
+
+	return result, nil
+}
+
+// saveAddonVersion records version of the installed addon, which is
+// reported by API v2 only, so failures are not fatal.
+func (operator *Operator) saveAddonVersion(
+	ctx context.Context,
+	bitbucketURL string,
+	id string,
+	profile config.Profile,
+) {
+	addon, err := operator.getAddon(ctx, bitbucketURL, profile)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to get addon version, container_id: %s",
+			id,
+		)
+		return
+	}
+
+	err = operator.database.SetContainerAddonVersion(id, addon.Version)
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to save addon version, container_id: %s",
+			id,
+		)
+	}
+}
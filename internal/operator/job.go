@@ -0,0 +1,454 @@
+package operator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/metrics"
+)
+
+var (
+	ErrJobNotFound = NewError(
+		constants.ERROR_KIND_NOT_FOUND,
+		"job not found",
+	)
+	ErrJobFinished = NewError(
+		constants.ERROR_KIND_CONFLICT,
+		"job is already finished",
+	)
+	ErrJobCancelled = NewError(
+		constants.ERROR_KIND_UNAVAILABLE,
+		"job is cancelled",
+	)
+)
+
+// Job describes provisioning of a container, percentage and message are
+// reported by Bitbucket while it boots.
+type Job struct {
+	ID          string     `json:"id"`
+	Pool        string     `json:"pool"`
+	Profile     string     `json:"profile,omitempty"`
+	Phase       string     `json:"phase"`
+	Percentage  int        `json:"percentage"`
+	Message     string     `json:"message,omitempty"`
+	ContainerID string     `json:"containerID,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Event is published every time the job changes, pull is set for events of
+// image pull progress.
+type Event struct {
+	Type string               `json:"type"`
+	Job  Job                  `json:"job"`
+	Pull *docker.PullProgress `json:"pull,omitempty"`
+}
+
+// Subscription receives events of the job until it's finished, the channel
+// is closed afterwards.
+type Subscription struct {
+	Job    Job
+	Events <-chan Event
+
+	job    *job
+	events chan Event
+}
+
+// job is provisioned within ctx, which is cancelled when the job is
+// cancelled or finished.
+type job struct {
+	ctx         context.Context
+	stop        context.CancelFunc
+	mutex       sync.Mutex
+	status      Job
+	cancelled   bool
+	subscribers map[chan Event]struct{}
+
+	phaseStartedAt time.Time
+}
+
+// StartJob provisions a new container in background and returns the job
+// right away.
+func (operator *Operator) StartJob(version, profileName string) (*Job, error) {
+	pool, err := operator.getPool(version)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := operator.getProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the job outlives the request, it's stopped by CancelJob only
+	job, err := operator.newJob(context.Background(), *pool, *profile)
+	if err != nil {
+		return nil, err
+	}
+
+	name := AddIDToContainerName(operator.config.Prefix)
+
+	go func() {
+		_, err := operator.handleNewContainer(name, job, *pool, *profile)
+		if err != nil {
+			log.Errorf(
+				err,
+				"provisioning job failed, job_id: %s",
+				job.status.ID,
+			)
+		}
+	}()
+
+	status := job.snapshot()
+
+	return &status, nil
+}
+
+func (operator *Operator) GetJobs() []Job {
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	jobs := []Job{}
+	for _, job := range operator.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs
+}
+
+func (operator *Operator) GetJob(id string) (*Job, error) {
+	operator.mutex.Lock()
+	job, ok := operator.jobs[id]
+	operator.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	status := job.snapshot()
+
+	return &status, nil
+}
+
+// CancelJob stops provisioning at the next step, the container is removed
+// once provisioning is stopped.
+func (operator *Operator) CancelJob(id string) (*Job, error) {
+	operator.mutex.Lock()
+	job, ok := operator.jobs[id]
+	operator.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	if !job.cancel() {
+		return nil, ErrJobFinished
+	}
+
+	log.Infof(nil, "provisioning job cancelled, job_id: %s", id)
+
+	status := job.snapshot()
+
+	return &status, nil
+}
+
+func (operator *Operator) SubscribeJob(id string) (*Subscription, error) {
+	operator.mutex.Lock()
+	job, ok := operator.jobs[id]
+	operator.mutex.Unlock()
+
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	return job.subscribe(), nil
+}
+
+// SubscribeContainer subscribes to the latest job which has provisioned
+// given container.
+func (operator *Operator) SubscribeContainer(
+	ctx context.Context,
+	id string,
+) (*Subscription, error) {
+	container, err := operator.getContainer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	operator.mutex.Lock()
+	var latest *job
+	for _, job := range operator.jobs {
+		status := job.snapshot()
+		if status.ContainerID != container.ID {
+			continue
+		}
+
+		if latest == nil || latest.snapshot().CreatedAt.Before(status.CreatedAt) {
+			latest = job
+		}
+	}
+	operator.mutex.Unlock()
+
+	if latest == nil {
+		return nil, ErrJobNotFound
+	}
+
+	return latest.subscribe(), nil
+}
+
+// State returns the current state of the job.
+func (subscription *Subscription) State() Job {
+	return subscription.job.snapshot()
+}
+
+func (subscription *Subscription) Close() {
+	subscription.job.unsubscribe(subscription.events)
+}
+
+// newJob registers a new job and forgets jobs finished earlier than
+// jobs.retention ago.
+func (operator *Operator) newJob(
+	ctx context.Context,
+	pool config.BitbucketPool,
+	profile config.Profile,
+) (*job, error) {
+	id, err := generateID()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to generate job id",
+		)
+	}
+
+	now := time.Now()
+
+	ctx, stop := context.WithCancel(ctx)
+
+	job := &job{
+		ctx:  ctx,
+		stop: stop,
+		status: Job{
+			ID:        id,
+			Pool:      pool.Version,
+			Profile:   profile.Name,
+			Phase:     constants.JOB_PHASE_PENDING,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		subscribers:    map[chan Event]struct{}{},
+		phaseStartedAt: now,
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if operator.draining {
+		stop()
+		return nil, ErrShuttingDown
+	}
+
+	for id, existing := range operator.jobs {
+		finishedAt := existing.snapshot().FinishedAt
+		if finishedAt != nil &&
+			now.Sub(*finishedAt) > operator.config.Jobs.Retention {
+			delete(operator.jobs, id)
+		}
+	}
+
+	operator.jobs[id] = job
+
+	return job, nil
+}
+
+// newDetachedJob returns a job which is not registered in the operator, it's
+// used for checks which are not reported as provisioning.
+func newDetachedJob(ctx context.Context) *job {
+	return &job{
+		ctx:         ctx,
+		stop:        func() {},
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+func (job *job) snapshot() Job {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.status
+}
+
+// subscribe returns subscription with closed channel if the job is
+// already finished.
+func (job *job) subscribe() *Subscription {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	events := make(chan Event, constants.JOB_EVENTS_BUFFER_SIZE)
+	if job.status.FinishedAt != nil {
+		close(events)
+	} else {
+		job.subscribers[events] = struct{}{}
+	}
+
+	return &Subscription{
+		Job:    job.status,
+		Events: events,
+		job:    job,
+		events: events,
+	}
+}
+
+func (job *job) unsubscribe(events chan Event) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if _, ok := job.subscribers[events]; ok {
+		delete(job.subscribers, events)
+		close(events)
+	}
+}
+
+// publish must be called with job.mutex held, events are dropped for
+// subscribers which don't keep up.
+func (job *job) publish(kind string, pull *docker.PullProgress) {
+	event := Event{
+		Type: kind,
+		Job:  job.status,
+		Pull: pull,
+	}
+
+	for events := range job.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (job *job) setPhase(phase string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	now := time.Now()
+
+	job.observePhase(now)
+	job.status.Phase = phase
+	job.status.UpdatedAt = now
+	job.publish(constants.JOB_EVENT_PHASE, nil)
+}
+
+func (job *job) setProgress(percentage int, message string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.status.Percentage = percentage
+	job.status.Message = message
+	job.status.UpdatedAt = time.Now()
+	job.publish(constants.JOB_EVENT_PROGRESS, nil)
+}
+
+func (job *job) setPull(pull docker.PullProgress) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.status.UpdatedAt = time.Now()
+	job.publish(constants.JOB_EVENT_PULL, &pull)
+}
+
+func (job *job) setContainer(id string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.status.ContainerID = id
+	job.status.UpdatedAt = time.Now()
+	job.publish(constants.JOB_EVENT_CONTAINER, nil)
+}
+
+// cancel returns false if the job is already finished.
+func (job *job) cancel() bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.status.FinishedAt != nil {
+		return false
+	}
+
+	job.cancelled = true
+	job.stop()
+
+	return true
+}
+
+// isCancelled returns true if the job is cancelled or its context is done,
+// for example, when the client which has requested the container is gone.
+func (job *job) isCancelled() bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.cancelled || job.ctx.Err() != nil
+}
+
+func (job *job) finish(container *types.Container, err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	now := time.Now()
+
+	job.observePhase(now)
+
+	switch {
+	case err == nil:
+		job.status.Phase = constants.JOB_PHASE_READY
+		job.status.ContainerID = container.ID
+	case job.cancelled || job.ctx.Err() != nil:
+		job.status.Phase = constants.JOB_PHASE_CANCELLED
+	default:
+		job.status.Phase = constants.JOB_PHASE_FAILED
+		job.status.Error = err.Error()
+	}
+
+	job.status.UpdatedAt = now
+	job.status.FinishedAt = &now
+	job.publish(constants.JOB_EVENT_FINISHED, nil)
+
+	if job.status.ID != "" {
+		metrics.ProvisioningJobs.
+			WithLabelValues(job.status.Pool, job.status.Phase).
+			Inc()
+	}
+
+	job.stop()
+
+	for events := range job.subscribers {
+		delete(job.subscribers, events)
+		close(events)
+	}
+}
+
+// observePhase records time spent in the current phase, detached jobs are
+// not recorded, must be called with job.mutex held.
+func (job *job) observePhase(now time.Time) {
+	if job.status.ID == "" {
+		return
+	}
+
+	metrics.ProvisioningDuration.
+		WithLabelValues(job.status.Pool, job.status.Phase).
+		Observe(now.Sub(job.phaseStartedAt).Seconds())
+
+	job.phaseStartedAt = now
+}
@@ -0,0 +1,581 @@
+package operator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+)
+
+var ErrContainerNotAllocated = NewError(
+	constants.ERROR_KIND_CONFLICT,
+	"container is not allocated",
+)
+
+type Release struct {
+	Lease                database.Lease `json:"lease"`
+	Outcome              string         `json:"outcome"`
+	ReplacementScheduled bool           `json:"replacementScheduled"`
+}
+
+type LeasedContainer struct {
+	types.Container
+	Lease *database.Lease `json:"lease"`
+}
+
+func newLease(
+	containerID string,
+	owner string,
+	duration time.Duration,
+) (*database.Lease, error) {
+	id, err := generateID()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to generate lease id",
+		)
+	}
+
+	now := time.Now()
+
+	return &database.Lease{
+		ID:          id,
+		ContainerID: containerID,
+		Owner:       owner,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(duration),
+	}, nil
+}
+
+func generateID() (string, error) {
+	buffer := make([]byte, 16)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
+
+// getLeaseByContainerID must be called with operator.mutex held.
+func (operator *Operator) getLeaseByContainerID(id string) *database.Lease {
+	for _, lease := range operator.leases {
+		if lease.ContainerID == id {
+			return lease
+		}
+	}
+
+	return nil
+}
+
+// finishLeasesOfContainer must be called with operator.mutex held.
+func (operator *Operator) finishLeasesOfContainer(
+	containerID string,
+	outcome string,
+) []database.Lease {
+	var finished []database.Lease
+	for id, lease := range operator.leases {
+		if lease.ContainerID != containerID {
+			continue
+		}
+
+		finishLease(lease, outcome)
+		finished = append(finished, *lease)
+
+		delete(operator.leases, id)
+	}
+
+	return finished
+}
+
+func finishLease(lease *database.Lease, outcome string) {
+	releasedAt := time.Now()
+	lease.ReleasedAt = &releasedAt
+	lease.Outcome = outcome
+}
+
+func (operator *Operator) saveFinishedLeases(leases []database.Lease) error {
+	for _, lease := range leases {
+		err := operator.database.SaveLease(lease)
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to save lease, lease_id: %s",
+				lease.ID,
+			)
+		}
+
+		err = operator.database.SetContainerAllocation(
+			lease.ContainerID, false, time.Time{},
+		)
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to update container allocation, container_id: %s",
+				lease.ContainerID,
+			)
+		}
+
+		log.Infof(
+			karma.Describe("lease_id", lease.ID).
+				Describe("owner", lease.Owner).
+				Describe("duration", lease.ReleasedAt.Sub(lease.CreatedAt)),
+			"lease finished, outcome: %s, container_id: %s",
+			lease.Outcome,
+			lease.ContainerID,
+		)
+	}
+
+	return nil
+}
+
+// saveLease must be called with operator.mutex held, the lease is added to
+// the operator leases only if it has been saved to the database.
+func (operator *Operator) saveLease(lease *database.Lease) error {
+	err := operator.writeLease(*lease)
+	if err != nil {
+		return err
+	}
+
+	operator.leases[lease.ID] = lease
+
+	return nil
+}
+
+// writeLease saves the lease and allocation of its container to the
+// database, it doesn't need operator.mutex.
+func (operator *Operator) writeLease(lease database.Lease) error {
+	err := operator.database.SaveLease(lease)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to save lease, lease_id: %s",
+			lease.ID,
+		)
+	}
+
+	err = operator.database.SetContainerAllocation(
+		lease.ContainerID, true, lease.CreatedAt,
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to update container allocation, container_id: %s",
+			lease.ContainerID,
+		)
+	}
+
+	return nil
+}
+
+// RestoreState reconciles containers and leases stored in the database with
+// containers existing in docker. Containers unknown to the database are
+// adopted as free ones, legacy containers are adopted together with leases
+// from their names.
+func (operator *Operator) RestoreState(ctx context.Context) error {
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	records, err := operator.database.GetContainers()
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from database",
+		)
+	}
+
+	leases, err := operator.database.GetActiveLeases()
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get active leases from database",
+		)
+	}
+
+	labeled, err := operator.docker.GetContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get labeled containers from docker",
+		)
+	}
+
+	existing := map[string]types.Container{}
+	for _, container := range containers {
+		existing[container.ID] = container
+	}
+
+	// quarantined containers are kept in the database until removed
+	for _, container := range labeled {
+		if isQuarantined(container) {
+			existing[container.ID] = container
+		}
+	}
+
+	recorded := map[string]bool{}
+	for _, record := range records {
+		if _, ok := existing[record.ID]; ok {
+			recorded[record.ID] = true
+			continue
+		}
+
+		log.Infof(
+			nil,
+			"container doesn't exist in docker anymore, container_id: %s",
+			record.ID,
+		)
+
+		err = operator.database.RemoveContainer(record.ID, time.Now())
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to mark container as removed, container_id: %s",
+				record.ID,
+			)
+		}
+	}
+
+	for _, container := range containers {
+		if recorded[container.ID] {
+			continue
+		}
+
+		log.Infof(nil, "adopting container, container_id: %s", container.ID)
+
+		err = operator.database.SaveContainer(
+			operator.getContainerData(container),
+		)
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to save container, container_id: %s",
+				container.ID,
+			)
+		}
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	var lost []database.Lease
+	for _, lease := range leases {
+		lease := lease
+		if _, ok := existing[lease.ContainerID]; !ok {
+			finishLease(&lease, constants.LEASE_OUTCOME_LOST)
+			lost = append(lost, lease)
+			continue
+		}
+
+		operator.leases[lease.ID] = &lease
+	}
+
+	err = operator.saveFinishedLeases(lost)
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		if recorded[container.ID] {
+			continue
+		}
+
+		if operator.getLeaseByContainerID(container.ID) != nil {
+			continue
+		}
+
+		lease, err := getLeaseOfContainer(container)
+		if err != nil {
+			log.Errorf(
+				err,
+				"unable to get lease of container, skipping, container_id: %s",
+				container.ID,
+			)
+			continue
+		}
+
+		if lease == nil {
+			continue
+		}
+
+		err = operator.saveLease(lease)
+		if err != nil {
+			return err
+		}
+
+		log.Infof(
+			karma.Describe("lease_id", lease.ID).
+				Describe("owner", lease.Owner).
+				Describe("expires_at", lease.ExpiresAt),
+			"lease restored, container_id: %s",
+			container.ID,
+		)
+	}
+
+	return nil
+}
+
+func (operator *Operator) getContainerData(
+	container types.Container,
+) docker.ContainerData {
+	data := docker.ContainerData{
+		Name:      strings.TrimPrefix(container.Names[0], "/"),
+		Image:     container.Image,
+		ID:        container.ID,
+		Username:  operator.config.Bitbucket.Username,
+		Password:  operator.config.Bitbucket.Password,
+		PortHTTP:  container.Labels[constants.LABEL_PORT_HTTP],
+		PortSSH:   container.Labels[constants.LABEL_PORT_SSH],
+		Date:      time.Unix(container.Created, 0),
+		Pool:      getPoolOfContainer(container),
+		Profile:   container.Labels[constants.LABEL_PROFILE],
+		AddonHash: container.Labels[constants.LABEL_ADDON_HASH],
+	}
+
+	for _, port := range container.Ports {
+		switch {
+		case port.PrivatePort == 7990 && data.PortHTTP == "":
+			data.PortHTTP = strconv.Itoa(int(port.PublicPort))
+		case port.PrivatePort == 7999 && data.PortSSH == "":
+			data.PortSSH = strconv.Itoa(int(port.PublicPort))
+		}
+	}
+
+	return data
+}
+
+// getLeaseOfContainer returns lease encoded in the name of legacy container,
+// leases of labeled containers are stored in the database only, since labels
+// can't be changed once the container is created.
+func getLeaseOfContainer(container types.Container) (*database.Lease, error) {
+	if _, ok := container.Labels[constants.LABEL_MANAGER]; ok {
+		return nil, nil
+	}
+
+	if !strings.Contains(
+		container.Names[0],
+		constants.ALLOCATED_CONTAINER_STATUS,
+	) {
+		return nil, nil
+	}
+
+	expiresAt, err := getDateOfAllocatedContainer(container.Names[0])
+	if err != nil {
+		return nil, err
+	}
+
+	lease, err := newLease(container.ID, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	lease.ExpiresAt = expiresAt
+
+	return lease, nil
+}
+
+// getLeaseTTL returns the requested TTL limited by the configured maximum,
+// or the default TTL if none requested.
+func (operator *Operator) getLeaseTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return operator.config.Lease.DefaultTTL
+	}
+
+	if ttl > operator.config.Lease.MaxTTL {
+		return operator.config.Lease.MaxTTL
+	}
+
+	return ttl
+}
+
+func (operator *Operator) GetLeasesOfContainer(
+	ctx context.Context,
+	containerID string,
+) ([]database.Lease, error) {
+	container, err := operator.getContainer(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	leases, err := operator.database.GetLeasesByContainerID(container.ID)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get leases from database, container_id: %s",
+			container.ID,
+		)
+	}
+
+	return leases, nil
+}
+
+// RenewLease pushes the expiration of the container lease forward by given
+// duration, but not further than the configured maximum lease TTL from now.
+func (operator *Operator) RenewLease(
+	ctx context.Context,
+	containerID string,
+	duration time.Duration,
+) (*database.Lease, error) {
+	container, err := operator.getContainer(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	containerID = container.ID
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	lease := operator.getLeaseByContainerID(containerID)
+	if lease == nil {
+		return nil, ErrContainerNotAllocated
+	}
+
+	expiresAt := lease.ExpiresAt.Add(duration)
+
+	limit := time.Now().Add(operator.config.Lease.MaxTTL)
+	if expiresAt.After(limit) {
+		expiresAt = limit
+	}
+
+	if expiresAt.After(lease.ExpiresAt) {
+		renewed := *lease
+		renewed.ExpiresAt = expiresAt
+
+		err = operator.database.SaveLease(renewed)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to save lease, lease_id: %s",
+				lease.ID,
+			)
+		}
+
+		lease.ExpiresAt = expiresAt
+
+		log.Infof(
+			karma.Describe("lease_id", lease.ID).
+				Describe("expires_at", lease.ExpiresAt),
+			"lease renewed, container_id: %s",
+			containerID,
+		)
+	}
+
+	result := *lease
+	return &result, nil
+}
+
+// ReleaseContainer finishes the lease of the container and either returns
+// the container back to the pool or, if recycle is set, removes it and
+// provisions a replacement in the background.
+func (operator *Operator) ReleaseContainer(
+	ctx context.Context,
+	containerID string,
+	recycle bool,
+) (*Release, error) {
+	container, err := operator.getContainer(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	containerID = container.ID
+
+	outcome := constants.LEASE_OUTCOME_RETURNED
+	if recycle {
+		outcome = constants.LEASE_OUTCOME_RECYCLED
+	}
+
+	operator.mutex.Lock()
+	if operator.getLeaseByContainerID(containerID) == nil {
+		operator.mutex.Unlock()
+		return nil, ErrContainerNotAllocated
+	}
+
+	// recycled container is held until removed, so it can't be allocated
+	// once the lease is finished
+	if recycle {
+		operator.holdContainer(*container)
+	}
+
+	finished := operator.finishLeasesOfContainer(containerID, outcome)
+	operator.mutex.Unlock()
+
+	if recycle {
+		defer operator.unholdContainers([]types.Container{*container})
+	}
+
+	lease := finished[0]
+
+	err = operator.saveFinishedLeases(finished)
+	if err != nil {
+		return nil, err
+	}
+
+	if !recycle {
+		operator.notifyQueue()
+
+		log.Infof(
+			karma.Describe("lease_id", lease.ID),
+			"container returned to the pool, container_id: %s",
+			containerID,
+		)
+
+		return &Release{
+			Lease:   lease,
+			Outcome: outcome,
+		}, nil
+	}
+
+	err = operator.RemoveContainers(ctx, []types.Container{*container})
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to remove container, container_id: %s",
+			containerID,
+		)
+	}
+
+	log.Infof(
+		karma.Describe("lease_id", lease.ID),
+		"container recycled, container_id: %s",
+		containerID,
+	)
+
+	// containers of the default profile are provisioned by the replenisher
+	profile := container.Labels[constants.LABEL_PROFILE]
+	if profile != "" {
+		go func() {
+			_, err := operator.HandleNewContainer(
+				context.Background(),
+				getPoolOfContainer(*container),
+				profile,
+			)
+			if err != nil {
+				log.Errorf(
+					err,
+					"unable to provision replacement for container, container_id: %s",
+					containerID,
+				)
+			}
+		}()
+	}
+
+	return &Release{
+		Lease:                lease,
+		Outcome:              outcome,
+		ReplacementScheduled: profile != "",
+	}, nil
+}
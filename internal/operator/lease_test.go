@@ -0,0 +1,302 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+func TestRestoreState(t *testing.T) {
+	docker := newFakeDocker(
+		newTestContainer("leased", "Up 5 minutes", 0),
+		newTestContainer("free", "Up 5 minutes", 0),
+	)
+
+	db := newFakeDatabase()
+	db.leases["l1"] = database.Lease{
+		ID:          "l1",
+		ContainerID: "leased",
+		Owner:       "ci",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	db.leases["l2"] = database.Lease{
+		ID:          "l2",
+		ContainerID: "removed",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	operator := newTestOperator(docker, db)
+
+	err := operator.RestoreState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease := operator.getLeaseByContainerID("leased")
+	if lease == nil || lease.Owner != "ci" {
+		t.Errorf("lease of leased container is not restored: %+v", lease)
+	}
+
+	if lease := operator.getLeaseByContainerID("free"); lease != nil {
+		t.Errorf("labeled container is adopted with lease: %+v", lease)
+	}
+
+	if db.leases["l2"].ReleasedAt == nil {
+		t.Errorf("lease of removed container is not finished")
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		duration  time.Duration
+		expected  time.Time
+	}{
+		{
+			name:      "extended",
+			expiresAt: now.Add(time.Hour),
+			duration:  time.Hour,
+			expected:  now.Add(2 * time.Hour),
+		},
+		{
+			name:      "limited by max ttl",
+			expiresAt: now.Add(3 * time.Hour),
+			duration:  2 * time.Hour,
+			expected:  now.Add(4 * time.Hour),
+		},
+		{
+			name:      "expired but not cleaned yet",
+			expiresAt: now.Add(-time.Minute),
+			duration:  time.Hour,
+			expected:  now.Add(59 * time.Minute),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := newFakeDocker(newTestContainer("c1", "Up 5 minutes", 0))
+			db := newFakeDatabase()
+			db.leases["l1"] = database.Lease{
+				ID:          "l1",
+				ContainerID: "c1",
+				ExpiresAt:   test.expiresAt,
+			}
+
+			operator := newTestOperator(docker, db)
+
+			ctx := context.Background()
+
+			err := operator.RestoreState(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lease, err := operator.RenewLease(ctx, "c1", test.duration)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the limit is counted from the time of renewal
+			if lease.ExpiresAt.Sub(test.expected) > time.Second ||
+				test.expected.Sub(lease.ExpiresAt) > time.Second {
+				t.Errorf(
+					"expires at %s, want %s",
+					lease.ExpiresAt, test.expected,
+				)
+			}
+
+			if !db.leases["l1"].ExpiresAt.Equal(lease.ExpiresAt) {
+				t.Errorf("renewed lease is not saved")
+			}
+
+			// renewed lease is not expired by the cleaner anymore
+			err = operator.CleanAllocatedContainers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(docker.removed) != 0 {
+				t.Errorf("removed = %v, want none", docker.removed)
+			}
+		})
+	}
+}
+
+func TestRenewLeaseErrors(t *testing.T) {
+	foreign := newTestContainer("foreign", "Up 5 minutes", 0)
+	foreign.Labels[constants.LABEL_MANAGER] = "other"
+
+	docker := newFakeDocker(
+		newTestContainer("free", "Up 5 minutes", 0),
+		foreign,
+	)
+
+	operator := newTestOperator(docker, newFakeDatabase())
+
+	tests := []struct {
+		id   string
+		kind string
+	}{
+		{"free", constants.ERROR_KIND_CONFLICT},
+		{"foreign", constants.ERROR_KIND_NOT_FOUND},
+		{"unknown", constants.ERROR_KIND_NOT_FOUND},
+	}
+
+	for _, test := range tests {
+		_, err := operator.RenewLease(context.Background(), test.id, time.Hour)
+		if GetErrorKind(err) != test.kind {
+			t.Errorf("%s: error = %v, want %s", test.id, err, test.kind)
+		}
+	}
+}
+
+func TestGetLeaseTTL(t *testing.T) {
+	operator := &Operator{
+		config: &config.Config{
+			Lease: config.Lease{
+				DefaultTTL: time.Hour,
+				MaxTTL:     4 * time.Hour,
+			},
+		},
+	}
+
+	tests := []struct {
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{0, time.Hour},
+		{-time.Minute, time.Hour},
+		{30 * time.Minute, 30 * time.Minute},
+		{4 * time.Hour, 4 * time.Hour},
+		{5 * time.Hour, 4 * time.Hour},
+	}
+
+	for _, test := range tests {
+		ttl := operator.getLeaseTTL(test.requested)
+		if ttl != test.expected {
+			t.Errorf(
+				"getLeaseTTL(%s) = %s, want %s",
+				test.requested, ttl, test.expected,
+			)
+		}
+	}
+}
+
+func TestRecycleContainer(t *testing.T) {
+	docker := newFakeDocker(newTestContainer("c1", "Up 5 minutes", 0))
+	db := newFakeDatabase()
+	db.leases["l1"] = database.Lease{
+		ID:          "l1",
+		ContainerID: "c1",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	operator := newTestOperator(docker, db)
+
+	ctx := context.Background()
+
+	err := operator.RestoreState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docker.onRemove = func() {
+		_, err := operator.AllocateContainer(ctx, "", "", "ci", 0)
+		if !karma.Contains(err, ErrContainersAllocated) {
+			t.Errorf(
+				"AllocateContainer() = %v, want %v",
+				err, ErrContainersAllocated,
+			)
+		}
+	}
+
+	release, err := operator.ReleaseContainer(ctx, "c1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if release.Outcome != constants.LEASE_OUTCOME_RECYCLED {
+		t.Errorf("outcome = %q, want recycled", release.Outcome)
+	}
+
+	if len(docker.removed) != 1 {
+		t.Errorf("removed = %v, want c1", docker.removed)
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if len(operator.leases) != 0 {
+		t.Errorf("leases = %v, want none", operator.leases)
+	}
+
+	if len(operator.provisioning) != 0 {
+		t.Errorf("provisioning = %v, want empty", operator.provisioning)
+	}
+}
+
+func TestRecycleContainerReplacement(t *testing.T) {
+	tests := []struct {
+		profile         string
+		wantReplacement bool
+	}{
+		{"", false},
+		{"mirror", true},
+	}
+
+	for _, test := range tests {
+		container := newTestContainer("c1", "Up 5 minutes", 0)
+		container.Labels[constants.LABEL_PROFILE] = test.profile
+
+		docker := newFakeDocker(container)
+		db := newFakeDatabase()
+		db.leases["l1"] = database.Lease{
+			ID:          "l1",
+			ContainerID: "c1",
+			ExpiresAt:   time.Now().Add(time.Hour),
+		}
+
+		operator := newTestOperator(docker, db)
+		operator.config.Profiles = []config.Profile{{Name: "mirror"}}
+		// replacement can't be provisioned, only scheduled
+		operator.config.Pool.MaxTotal = 0
+
+		ctx := context.Background()
+
+		err := operator.RestoreState(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		release, err := operator.ReleaseContainer(ctx, "c1", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if release.ReplacementScheduled != test.wantReplacement {
+			t.Errorf(
+				"profile %q: replacement scheduled = %v, want %v",
+				test.profile, release.ReplacementScheduled,
+				test.wantReplacement,
+			)
+		}
+
+		if !test.wantReplacement {
+			operator.mutex.Lock()
+			jobs := len(operator.jobs)
+			operator.mutex.Unlock()
+
+			if jobs != 0 {
+				t.Errorf("profile %q: %d jobs started, want none", test.profile, jobs)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package operator
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+// ContainerQuery filters, sorts and paginates listing of containers, zero
+// values don't filter anything, zero Limit returns all containers.
+type ContainerQuery struct {
+	States  []string
+	Version string
+	Owner   string
+	MinAge  time.Duration
+	MaxAge  time.Duration
+	Sort    string
+	Order   string
+	Offset  int
+	Limit   int
+}
+
+type listedContainer struct {
+	container types.Container
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+func (query ContainerQuery) validate() error {
+	for _, state := range query.States {
+		switch state {
+		case constants.CONTAINER_STATE_FREE,
+			constants.CONTAINER_STATE_LEASED,
+			constants.CONTAINER_STATE_PROVISIONING,
+			constants.CONTAINER_STATE_STOPPED,
+			constants.CONTAINER_STATE_FAILED:
+		default:
+			return NewError(
+				constants.ERROR_KIND_INVALID_INPUT,
+				"unknown state: "+state,
+			)
+		}
+	}
+
+	switch {
+	case query.Sort != "" &&
+		query.Sort != constants.SORT_CREATED &&
+		query.Sort != constants.SORT_EXPIRES:
+		return NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			"unknown sort: "+query.Sort,
+		)
+	case query.Order != "" &&
+		query.Order != constants.ORDER_ASC &&
+		query.Order != constants.ORDER_DESC:
+		return NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			"unknown order: "+query.Order,
+		)
+	case query.Offset < 0:
+		return NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			"offset must not be negative",
+		)
+	case query.Limit < 0:
+		return NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			"limit must not be negative",
+		)
+	case query.MaxAge > 0 && query.MinAge > query.MaxAge:
+		return NewError(
+			constants.ERROR_KIND_INVALID_INPUT,
+			"min_age must not exceed max_age",
+		)
+	}
+
+	return nil
+}
+
+// queryContainers returns the requested page of containers of this manager
+// including quarantined ones, and the number of containers matching the
+// query.
+func (operator *Operator) queryContainers(
+	ctx context.Context,
+	query ContainerQuery,
+) ([]types.Container, int, error) {
+	err := query.validate()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	containers, err := operator.listContainers(ctx)
+	if err != nil {
+		return nil, 0, karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	now := time.Now()
+
+	operator.mutex.Lock()
+
+	seen := map[string]bool{}
+	listed := []listedContainer{}
+	for _, container := range containers {
+		if seen[container.ID] {
+			continue
+		}
+
+		seen[container.ID] = true
+
+		if !operator.matchContainer(container, query, now) {
+			continue
+		}
+
+		item := listedContainer{
+			container: container,
+			createdAt: time.Unix(container.Created, 0),
+		}
+
+		lease := operator.getLeaseByContainerID(container.ID)
+		if lease != nil {
+			expiresAt := lease.ExpiresAt
+			item.expiresAt = &expiresAt
+		}
+
+		listed = append(listed, item)
+	}
+
+	operator.mutex.Unlock()
+
+	sortContainers(listed, query.Sort, query.Order == constants.ORDER_DESC)
+
+	total := len(listed)
+
+	if query.Offset >= len(listed) {
+		listed = nil
+	} else {
+		listed = listed[query.Offset:]
+	}
+
+	if query.Limit > 0 && query.Limit < len(listed) {
+		listed = listed[:query.Limit]
+	}
+
+	result := []types.Container{}
+	for _, item := range listed {
+		result = append(result, item.container)
+	}
+
+	return result, total, nil
+}
+
+// matchContainer must be called with operator.mutex held.
+func (operator *Operator) matchContainer(
+	container types.Container,
+	query ContainerQuery,
+	now time.Time,
+) bool {
+	if len(query.States) > 0 {
+		state := operator.getContainerState(container)
+
+		found := false
+		for _, expected := range query.States {
+			if state == expected {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if query.Version != "" && getPoolOfContainer(container) != query.Version {
+		return false
+	}
+
+	if query.Owner != "" {
+		lease := operator.getLeaseByContainerID(container.ID)
+		if lease == nil || lease.Owner != query.Owner {
+			return false
+		}
+	}
+
+	age := now.Sub(time.Unix(container.Created, 0))
+
+	if query.MinAge > 0 && age < query.MinAge {
+		return false
+	}
+
+	if query.MaxAge > 0 && age > query.MaxAge {
+		return false
+	}
+
+	return true
+}
+
+// sortContainers sorts containers by creation time or by lease expiration,
+// containers which aren't leased are placed after leased ones in both orders
+// when sorted by expiration.
+func sortContainers(
+	containers []listedContainer,
+	by string,
+	descending bool,
+) {
+	sort.SliceStable(containers, func(i, j int) bool {
+		a, b := containers[i], containers[j]
+
+		if by == constants.SORT_EXPIRES {
+			switch {
+			case a.expiresAt != nil && b.expiresAt == nil:
+				return true
+			case a.expiresAt == nil && b.expiresAt != nil:
+				return false
+			case a.expiresAt != nil && !a.expiresAt.Equal(*b.expiresAt):
+				if descending {
+					return a.expiresAt.After(*b.expiresAt)
+				}
+
+				return a.expiresAt.Before(*b.expiresAt)
+			}
+		}
+
+		if descending {
+			return a.createdAt.After(b.createdAt)
+		}
+
+		return a.createdAt.Before(b.createdAt)
+	})
+}
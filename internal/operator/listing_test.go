@@ -0,0 +1,244 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+func TestContainerQueryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query ContainerQuery
+		valid bool
+	}{
+		{"empty", ContainerQuery{}, true},
+		{
+			"all states",
+			ContainerQuery{States: []string{
+				constants.CONTAINER_STATE_FREE,
+				constants.CONTAINER_STATE_LEASED,
+				constants.CONTAINER_STATE_PROVISIONING,
+				constants.CONTAINER_STATE_STOPPED,
+				constants.CONTAINER_STATE_FAILED,
+			}},
+			true,
+		},
+		{"unknown state", ContainerQuery{States: []string{"gone"}}, false},
+		{"sort by created", ContainerQuery{Sort: constants.SORT_CREATED}, true},
+		{"sort by expires", ContainerQuery{Sort: constants.SORT_EXPIRES}, true},
+		{"unknown sort", ContainerQuery{Sort: "name"}, false},
+		{"descending", ContainerQuery{Order: constants.ORDER_DESC}, true},
+		{"unknown order", ContainerQuery{Order: "random"}, false},
+		{"negative offset", ContainerQuery{Offset: -1}, false},
+		{"negative limit", ContainerQuery{Limit: -1}, false},
+		{"min age only", ContainerQuery{MinAge: time.Hour}, true},
+		{
+			"min age below max age",
+			ContainerQuery{MinAge: time.Minute, MaxAge: time.Hour},
+			true,
+		},
+		{
+			"min age above max age",
+			ContainerQuery{MinAge: time.Hour, MaxAge: time.Minute},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.query.validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if !test.valid &&
+			GetErrorKind(err) != constants.ERROR_KIND_INVALID_INPUT {
+			t.Errorf("%s: error = %v, want invalid input", test.name, err)
+		}
+	}
+}
+
+func TestMatchContainer(t *testing.T) {
+	now := time.Now()
+
+	newContainer := func(
+		id string,
+		status string,
+		pool string,
+		age time.Duration,
+	) types.Container {
+		return types.Container{
+			ID:      id,
+			Names:   []string{"/bitbucket-" + id},
+			Status:  status,
+			Created: now.Add(-age).Unix(),
+			Labels:  map[string]string{constants.LABEL_POOL: pool},
+		}
+	}
+
+	free := newContainer("free", "Up 5 minutes", "6.8.0", time.Hour)
+	leased := newContainer("leased", "Up 5 minutes", "6.8.0", 3*time.Hour)
+	stopped := newContainer("stopped", "Exited (0)", "6.8.0", 0)
+	other := newContainer("other", "Up 5 minutes", "7.6.0", 0)
+
+	operator := &Operator{
+		leases: map[string]*database.Lease{
+			"lease": {
+				ID:          "lease",
+				ContainerID: "leased",
+				Owner:       "ci",
+				ExpiresAt:   now.Add(time.Hour),
+			},
+		},
+		provisioning: map[string]provisioningContainer{},
+	}
+
+	containers := []types.Container{free, leased, stopped, other}
+
+	tests := []struct {
+		name     string
+		query    ContainerQuery
+		expected []string
+	}{
+		{
+			"no filters",
+			ContainerQuery{},
+			[]string{"free", "leased", "stopped", "other"},
+		},
+		{
+			"state",
+			ContainerQuery{States: []string{
+				constants.CONTAINER_STATE_LEASED,
+				constants.CONTAINER_STATE_STOPPED,
+			}},
+			[]string{"leased", "stopped"},
+		},
+		{
+			"version",
+			ContainerQuery{Version: "7.6.0"},
+			[]string{"other"},
+		},
+		{
+			"owner",
+			ContainerQuery{Owner: "ci"},
+			[]string{"leased"},
+		},
+		{
+			"unknown owner",
+			ContainerQuery{Owner: "dev"},
+			nil,
+		},
+		{
+			"min age",
+			ContainerQuery{MinAge: 30 * time.Minute},
+			[]string{"free", "leased"},
+		},
+		{
+			"max age",
+			ContainerQuery{MaxAge: 2 * time.Hour},
+			[]string{"free", "stopped", "other"},
+		},
+		{
+			"age range",
+			ContainerQuery{MinAge: 30 * time.Minute, MaxAge: 2 * time.Hour},
+			[]string{"free"},
+		},
+	}
+
+	for _, test := range tests {
+		var matched []string
+		for _, container := range containers {
+			if operator.matchContainer(container, test.query, now) {
+				matched = append(matched, container.ID)
+			}
+		}
+
+		if !equalStrings(matched, test.expected) {
+			t.Errorf(
+				"%s: matched = %v, want %v",
+				test.name, matched, test.expected,
+			)
+		}
+	}
+}
+
+func TestSortContainers(t *testing.T) {
+	now := time.Now()
+
+	at := func(hours int) *time.Time {
+		value := now.Add(time.Duration(hours) * time.Hour)
+		return &value
+	}
+
+	containers := []listedContainer{
+		{
+			container: types.Container{ID: "a"},
+			createdAt: *at(-1),
+			expiresAt: at(3),
+		},
+		{
+			container: types.Container{ID: "b"},
+			createdAt: *at(-3),
+		},
+		{
+			container: types.Container{ID: "c"},
+			createdAt: *at(-2),
+			expiresAt: at(1),
+		},
+		{
+			container: types.Container{ID: "d"},
+			createdAt: *at(-4),
+			expiresAt: at(1),
+		},
+		{
+			container: types.Container{ID: "e"},
+			createdAt: *at(-5),
+		},
+	}
+
+	tests := []struct {
+		by         string
+		descending bool
+		expected   []string
+	}{
+		{"", false, []string{"e", "d", "b", "c", "a"}},
+		{constants.SORT_CREATED, false, []string{"e", "d", "b", "c", "a"}},
+		{constants.SORT_CREATED, true, []string{"a", "c", "b", "d", "e"}},
+		{constants.SORT_EXPIRES, false, []string{"d", "c", "a", "e", "b"}},
+		{constants.SORT_EXPIRES, true, []string{"a", "c", "d", "b", "e"}},
+	}
+
+	for _, test := range tests {
+		sorted := append([]listedContainer{}, containers...)
+		sortContainers(sorted, test.by, test.descending)
+
+		var ids []string
+		for _, item := range sorted {
+			ids = append(ids, item.container.ID)
+		}
+
+		if !equalStrings(ids, test.expected) {
+			t.Errorf(
+				"sort %q descending %v: %v, want %v",
+				test.by, test.descending, ids, test.expected,
+			)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
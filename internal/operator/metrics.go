@@ -0,0 +1,77 @@
+package operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/metrics"
+)
+
+// UpdateMetrics sets gauges of containers and the queue to the current
+// state, it's called on every scrape.
+func (operator *Operator) UpdateMetrics(ctx context.Context) error {
+	containers, err := operator.listContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	counts := map[string]map[string]int{}
+	for _, pool := range operator.config.Pools {
+		counts[pool.Version] = map[string]int{}
+	}
+
+	count := func(pool string, state string) {
+		if _, ok := counts[pool]; !ok {
+			counts[pool] = map[string]int{}
+		}
+
+		counts[pool][state]++
+	}
+
+	for _, container := range operator.provisioning {
+		count(container.pool, constants.CONTAINER_STATE_PROVISIONING)
+	}
+
+	for _, container := range containers {
+		state := operator.getContainerState(container)
+		if state == constants.CONTAINER_STATE_PROVISIONING {
+			// already counted by the provisioning reservations
+			continue
+		}
+
+		count(getPoolOfContainer(container), state)
+	}
+
+	metrics.Containers.Reset()
+	for pool, states := range counts {
+		for _, state := range []string{
+			constants.CONTAINER_STATE_FREE,
+			constants.CONTAINER_STATE_LEASED,
+			constants.CONTAINER_STATE_PROVISIONING,
+			constants.CONTAINER_STATE_STOPPED,
+			constants.CONTAINER_STATE_FAILED,
+		} {
+			metrics.Containers.
+				WithLabelValues(pool, state).
+				Set(float64(states[state]))
+		}
+	}
+
+	metrics.QueueLength.Set(float64(len(operator.queue)))
+
+	return nil
+}
+
+func observeAllocation(pool string, source string, startedAt time.Time) {
+	metrics.AllocationDuration.
+		WithLabelValues(pool, source).
+		Observe(time.Since(startedAt).Seconds())
+}
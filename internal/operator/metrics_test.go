@@ -0,0 +1,75 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/metrics"
+)
+
+func TestUpdateMetrics(t *testing.T) {
+	quarantined := newTestContainer("quarantined", "Exited (1)", 0)
+	quarantined.Names = []string{
+		"/" + testPrefix + "-quarantined" + constants.QUARANTINE_SUFFIX,
+	}
+
+	docker := newFakeDocker(
+		newTestContainer("free", "Up 5 minutes", 0),
+		newTestContainer("leased", "Up 5 minutes", 0),
+		newTestContainer("leased-stopped", "Exited (0)", 0),
+		newTestContainer("stopped", "Exited (0)", 0),
+		newTestContainer("created", "Created", 0),
+		quarantined,
+	)
+
+	db := newFakeDatabase()
+	for _, id := range []string{"leased", "leased-stopped"} {
+		db.leases[id] = database.Lease{
+			ID:          id,
+			ContainerID: id,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		}
+	}
+
+	operator := newTestOperator(docker, db)
+
+	err := operator.RestoreState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = operator.UpdateMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pool  string
+		state string
+		count float64
+	}{
+		{"6.8.0", constants.CONTAINER_STATE_FREE, 1},
+		{"6.8.0", constants.CONTAINER_STATE_LEASED, 2},
+		{"6.8.0", constants.CONTAINER_STATE_STOPPED, 2},
+		{"6.8.0", constants.CONTAINER_STATE_FAILED, 1},
+		{"6.8.0", constants.CONTAINER_STATE_PROVISIONING, 0},
+		{"7.6.0", constants.CONTAINER_STATE_FREE, 0},
+		{"7.6.0", constants.CONTAINER_STATE_STOPPED, 0},
+	}
+
+	for _, test := range tests {
+		count := testutil.ToFloat64(
+			metrics.Containers.WithLabelValues(test.pool, test.state),
+		)
+		if count != test.count {
+			t.Errorf(
+				"%s/%s: count = %v, want %v",
+				test.pool, test.state, count, test.count,
+			)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package operator
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,24 +15,45 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/kovetskiy/stash"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/metrics"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/options"
 )
 
 type Operator struct {
-	config *config.Config
-	docker docker.DockerService
-	opts   options.DocoptOptions
+	config   *config.Config
+	docker   docker.DockerService
+	database database.DatabaseService
+	opts     options.DocoptOptions
+
+	mutex        sync.Mutex
+	leases       map[string]*database.Lease
+	provisioning map[string]provisioningContainer
+	replenish    chan struct{}
+	waiters      map[string]*waiter
+	queue        []*waiter
+	dequeue      chan struct{}
+	jobs         map[string]*job
+	slots        chan struct{}
+	draining     bool
+
+	networkCreated bool
+	poolFilled     bool
+	reconciled     bool
 }
 
 type StartupStatus struct {
@@ -40,22 +64,66 @@ type StartupStatus struct {
 	}
 }
 
-var ErrContainersAllocated = errors.New("all free containers allocated")
+type provisioningContainer struct {
+	pool    string
+	profile string
+	lease   *database.Lease
+}
+
+var (
+	ErrContainersAllocated = NewError(
+		constants.ERROR_KIND_CAPACITY_EXHAUSTED,
+		"all free containers allocated",
+	)
+	ErrLimitExceeded = NewError(
+		constants.ERROR_KIND_CAPACITY_EXHAUSTED,
+		"limit of created containers exceeded",
+	)
+	ErrStartupTimeout = NewError(
+		constants.ERROR_KIND_PROVISIONING_FAILED,
+		"bitbucket hasn't started in time",
+	)
+	ErrUnknownPool = NewError(
+		constants.ERROR_KIND_INVALID_INPUT,
+		"unknown bitbucket version",
+	)
+	ErrUnknownProfile = NewError(
+		constants.ERROR_KIND_INVALID_INPUT,
+		"unknown profile",
+	)
+	ErrContainerNotFound = NewError(
+		constants.ERROR_KIND_NOT_FOUND,
+		"container is not found",
+	)
+	ErrShuttingDown = NewError(
+		constants.ERROR_KIND_UNAVAILABLE,
+		"pool manager is shutting down",
+	)
+)
 
 func NewOperator(
 	config *config.Config,
 	docker docker.DockerService,
+	databaseService database.DatabaseService,
 	opts options.DocoptOptions,
 ) *Operator {
 	return &Operator{
-		config: config,
-		docker: docker,
-		opts:   opts,
+		config:       config,
+		docker:       docker,
+		database:     databaseService,
+		opts:         opts,
+		leases:       map[string]*database.Lease{},
+		provisioning: map[string]provisioningContainer{},
+		replenish:    make(chan struct{}, 1),
+		waiters:      map[string]*waiter{},
+		dequeue:      make(chan struct{}, 1),
+		jobs:         map[string]*job{},
+		slots:        make(chan struct{}, config.Provisioning.Concurrency),
 	}
 }
 
-func (operator *Operator) CreateNetwork() error {
-	err := operator.docker.CreateNetwork()
+func (operator *Operator) CreateNetwork(ctx context.Context) error {
+	err := operator.docker.CreateNetwork(ctx)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -63,70 +131,267 @@ func (operator *Operator) CreateNetwork() error {
 		)
 	}
 
+	operator.mutex.Lock()
+	operator.networkCreated = true
+	operator.mutex.Unlock()
+
 	return nil
 }
 
-func (operator *Operator) RunInitialContainers() error {
-	log.Info("validating number of existing containers")
-	result, total, err := operator.isExceedsNumberOfCreatedContainers(
-		constants.INITIAL_NUMBER_OF_CONTAINERS,
+func (operator *Operator) GetContainerByID(
+	ctx context.Context,
+	id string,
+) (*types.Container, error) {
+	container, err := operator.getContainer(ctx, id)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get container by id from the docker, container_id: %s",
+			id,
+		)
+	}
+
+	return container, nil
+}
+
+func (operator *Operator) HandleNewContainer(
+	ctx context.Context,
+	version string,
+	profileName string,
+) (*types.Container, error) {
+	pool, err := operator.getPool(version)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := operator.getProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := operator.newJob(ctx, *pool, *profile)
+	if err != nil {
+		return nil, err
+	}
+
+	name := AddIDToContainerName(operator.config.Prefix)
+
+	return operator.handleNewContainer(name, job, *pool, *profile)
+}
+
+func (operator *Operator) handleNewContainer(
+	name string,
+	job *job,
+	pool config.BitbucketPool,
+	profile config.Profile,
+) (*types.Container, error) {
+	container, err := operator.provisionContainer(
+		name, pool, profile, nil, job,
 	)
+	operator.mutex.Lock()
+	delete(operator.provisioning, name)
+	operator.mutex.Unlock()
 	if err != nil {
-		return karma.Format(
+		return nil, err
+	}
+
+	operator.notifyQueue()
+
+	return container, nil
+}
+
+// provisionContainer creates and configures a new container with given
+// name, the name is kept in the provisioning set, so the container can't be
+// allocated until the caller removes it from there. The name is reserved
+// here unless the caller has already reserved it. If lease is given, the
+// container is reserved for the lease holder. Progress is reported to
+// the job, which is finished once the container is ready or failed.
+// At most provisioning.concurrency containers are provisioned at once.
+func (operator *Operator) provisionContainer(
+	name string,
+	pool config.BitbucketPool,
+	profile config.Profile,
+	lease *database.Lease,
+	job *job,
+) (*types.Container, error) {
+	ctx := job.ctx
+
+	operator.mutex.Lock()
+	_, reserved := operator.provisioning[name]
+	operator.mutex.Unlock()
+
+	var err error
+	if !reserved {
+		var containers []types.Container
+		containers, err = operator.getManagedContainers(ctx)
+		if err == nil {
+			operator.mutex.Lock()
+			err = operator.reserveContainer(
+				containers, name, pool, profile, lease,
+			)
+			operator.mutex.Unlock()
+		}
+	}
+
+	if err == nil {
+		err = operator.acquireSlot(job)
+	}
+
+	if err != nil {
+		job.finish(nil, err)
+		return nil, err
+	}
+
+	defer operator.releaseSlot()
+
+	container, err := operator.CreateAndStartContainer(
+		ctx, name, pool, profile, job,
+	)
+	if err != nil {
+		err = karma.Format(
 			err,
-			"unable to validate number of existing containers",
+			"unable to create and start container",
+		)
+	} else {
+		var configured *types.Container
+		configured, err = operator.configureContainer(
+			ctx, container, profile, job,
 		)
+		if err == nil {
+			job.finish(configured, nil)
+			return configured, nil
+		}
 	}
 
-	if result {
-		log.Infof(
-			nil,
-			"initial containers have already created, number of initial containers: %d",
-			constants.INITIAL_NUMBER_OF_CONTAINERS,
+	operator.rollbackContainer(job, err)
+
+	if !job.isCancelled() {
+		err = karma.Push(err, ErrProvisioningFailed)
+	}
+
+	job.finish(nil, err)
+
+	return nil, err
+}
+
+// rollbackContainer removes container of the failed job together with its
+// volume, or stops and quarantines it if provisioning.quarantine is set.
+// Containers of cancelled jobs are always removed.
+func (operator *Operator) rollbackContainer(job *job, cause error) {
+	id := job.snapshot().ContainerID
+	if id == "" {
+		return
+	}
+
+	// context of the job may be cancelled already
+	ctx := context.Background()
+
+	var err error
+	if operator.config.Provisioning.Quarantine && !job.isCancelled() {
+		err = operator.quarantineContainer(ctx, id, cause)
+	} else {
+		log.Infof(nil, "rolling back container, container_id: %s", id)
+		err = operator.RemoveContainerByID(ctx, id)
+	}
+
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to roll back container of failed job, container_id: %s",
+			id,
 		)
-		return nil
 	}
+}
 
-	log.Info("creating initial containers")
-	for i := 0; i < constants.INITIAL_NUMBER_OF_CONTAINERS-total; i++ {
-		_, err := operator.HandleNewContainer()
+// quarantineContainer stops the container and renames it, so it's kept for
+// debugging, but neither allocated nor counted against limits.
+func (operator *Operator) quarantineContainer(
+	ctx context.Context,
+	id string,
+	cause error,
+) error {
+	container, err := operator.getContainer(ctx, id)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get container by id from the docker, container_id: %s",
+			id,
+		)
+	}
+
+	if handleStatusOfContainer(container.Status) == constants.CONTAINER_STATUS_UP {
+		err = operator.docker.StopContainer(ctx, id)
 		if err != nil {
 			return karma.Format(
 				err,
-				"unable to handle new container",
+				"unable to stop container, container_id: %s",
+				id,
 			)
 		}
 	}
 
-	log.Info("initial containers successfully created")
+	name := strings.TrimPrefix(container.Names[0], "/") +
+		constants.QUARANTINE_SUFFIX
+
+	err = operator.docker.RenameContainer(ctx, id, name)
+	if err != nil {
+		return err
+	}
+
+	err = operator.database.QuarantineContainer(id, cause.Error(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Warningf(
+		cause,
+		"container quarantined, container_id: %s, name: %s",
+		id, name,
+	)
 
 	return nil
 }
 
-func (operator *Operator) GetContainerByID(id string) (*types.Container, error) {
-	container, err := operator.docker.GetContainerByID(id)
+func (operator *Operator) GetQuarantinedContainers() (
+	[]docker.ContainerData,
+	error,
+) {
+	records, err := operator.database.GetContainers()
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to get container by id from the docker, container_id: %s",
-			id,
+			"unable to get containers from database",
 		)
 	}
 
-	return container, nil
+	result := []docker.ContainerData{}
+	for _, record := range records {
+		if record.QuarantinedAt != nil {
+			result = append(result, record)
+		}
+	}
+
+	return result, nil
 }
 
-func (operator *Operator) HandleNewContainer() (*types.Container, error) {
-	container, err := operator.CreateAndStartContainer()
-	if err != nil {
-		return nil, karma.Format(
-			err,
-			"unable to create and start container",
-		)
+func isQuarantined(container types.Container) bool {
+	for _, name := range container.Names {
+		if strings.HasSuffix(name, constants.QUARANTINE_SUFFIX) {
+			return true
+		}
 	}
 
+	return false
+}
+
+func (operator *Operator) configureContainer(
+	ctx context.Context,
+	container *docker.ContainerData,
+	profile config.Profile,
+	job *job,
+) (*types.Container, error) {
 	bitbucketURL := operator.GetURI("", container.PortHTTP)
-	err = operator.ValidateStartupStatus(bitbucketURL, container)
+	err := operator.ValidateStartupStatus(ctx, bitbucketURL, container, job)
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -135,7 +400,11 @@ func (operator *Operator) HandleNewContainer() (*types.Container, error) {
 		)
 	}
 
-	err = operator.InstallAddonAndSetLicense(bitbucketURL)
+	if job.isCancelled() {
+		return nil, ErrJobCancelled
+	}
+
+	err = operator.InstallAddonAndSetLicense(ctx, bitbucketURL, profile, job)
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -144,7 +413,9 @@ func (operator *Operator) HandleNewContainer() (*types.Container, error) {
 		)
 	}
 
-	createdContainer, err := operator.docker.GetContainerByID(container.ID)
+	operator.saveAddonVersion(ctx, bitbucketURL, container.ID, profile)
+
+	createdContainer, err := operator.getContainer(ctx, container.ID)
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -158,7 +429,7 @@ func (operator *Operator) HandleNewContainer() (*types.Container, error) {
 
 func getDateOfAllocatedContainer(name string) (time.Time, error) {
 	splittedName := strings.Split(name, "---")
-	if len(splittedName) < 1 {
+	if len(splittedName) < 2 {
 		return time.Time{}, karma.Describe("container_name", name).
 			Reason(errors.New("unable to get date of allocated container"))
 	}
@@ -181,59 +452,84 @@ func getDateOfAllocatedContainer(name string) (time.Time, error) {
 	return allocatedTime, nil
 }
 
-func getOverdueContainers(
-	containers []types.Container,
-) ([]types.Container, error) {
-	var result []types.Container
-	for _, container := range containers {
-		expirationDate, err := getDateOfAllocatedContainer(container.Names[0])
-		if err != nil {
-			return nil, err
-		}
+func (operator *Operator) CleanAllocatedContainers(ctx context.Context) error {
+	metrics.CleanerRuns.Inc()
 
-		nowDate, err := time.Parse(
-			constants.TIME_FORMAT,
-			time.Now().Format(constants.TIME_FORMAT),
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		if nowDate.After(expirationDate) {
-			result = append(result, container)
+	operator.mutex.Lock()
+	var ids []string
+	now := time.Now()
+	for _, lease := range operator.leases {
+		if now.After(lease.ExpiresAt) {
+			ids = append(ids, lease.ContainerID)
 		}
 	}
+	operator.mutex.Unlock()
 
-	return result, nil
-}
+	if len(ids) == 0 {
+		return nil
+	}
 
-func (operator *Operator) CleanAllocatedContainers() error {
-	containers, err := operator.docker.GetAllocatedContainers()
+	overdueContainers, err := operator.docker.GetContainersByIDs(ctx, ids)
 	if err != nil {
 		return karma.Format(
 			err,
-			"unable to get allocated containers from docker",
+			"unable to get allocated overdue containers from docker",
 		)
 	}
 
-	if len(containers) == 0 {
-		return nil
+	found := map[string]bool{}
+	for _, container := range overdueContainers {
+		found[container.ID] = true
+	}
+
+	var (
+		expired  []database.Lease
+		removing []types.Container
+	)
+
+	operator.mutex.Lock()
+	now = time.Now()
+	// leases could be renewed or released while containers were listed
+	for _, id := range ids {
+		lease := operator.getLeaseByContainerID(id)
+		if lease == nil || !now.After(lease.ExpiresAt) {
+			found[id] = false
+			continue
+		}
+
+		expired = append(
+			expired,
+			operator.finishLeasesOfContainer(
+				id, constants.LEASE_OUTCOME_EXPIRED,
+			)...,
+		)
+	}
+
+	// containers are held until removed, so they can't be allocated again
+	for _, container := range overdueContainers {
+		if found[container.ID] && !operator.isProvisioning(container) {
+			operator.holdContainer(container)
+			removing = append(removing, container)
+		}
 	}
+	operator.mutex.Unlock()
 
-	overdueContainers, err := getOverdueContainers(containers)
+	defer operator.unholdContainers(removing)
+
+	err = operator.saveFinishedLeases(expired)
 	if err != nil {
 		return karma.Format(
 			err,
-			"unable to get allocated overdue containers from docker",
+			"unable to save expired leases",
 		)
 	}
 
-	if len(overdueContainers) == 0 {
+	if len(removing) == 0 {
 		return nil
 	}
 
 	log.Info("removing allocated containers")
-	err = operator.RemoveContainers(overdueContainers)
+	err = operator.RemoveContainers(ctx, removing)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -241,13 +537,18 @@ func (operator *Operator) CleanAllocatedContainers() error {
 		)
 	}
 
+	metrics.CleanerRemovals.Add(float64(len(removing)))
+
 	log.Info("outdated allocated containers successfully removed")
 	return nil
 }
 
-func (operator *Operator) RemoveContainerByID(id string) error {
+func (operator *Operator) RemoveContainerByID(
+	ctx context.Context,
+	id string,
+) error {
 	log.Infof(nil, "removing container by id: %s", id)
-	container, err := operator.docker.GetContainerByID(id)
+	container, err := operator.getContainer(ctx, id)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -258,7 +559,7 @@ func (operator *Operator) RemoveContainerByID(id string) error {
 
 	var containers []types.Container
 	containers = append(containers, *container)
-	err = operator.RemoveContainers(containers)
+	err = operator.RemoveContainers(ctx, containers)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -272,13 +573,16 @@ func (operator *Operator) RemoveContainerByID(id string) error {
 	return nil
 }
 
-func (operator *Operator) RemoveContainers(containers []types.Container) error {
+func (operator *Operator) RemoveContainers(
+	ctx context.Context,
+	containers []types.Container,
+) error {
 	if len(containers) == 0 {
 		return nil
 	}
 
 	for _, container := range containers {
-		status, err := operator.GetStatusOfContainerByID(container.ID)
+		status, err := operator.GetStatusOfContainerByID(ctx, container.ID)
 		if err != nil {
 			return karma.Format(
 				err,
@@ -287,9 +591,10 @@ func (operator *Operator) RemoveContainers(containers []types.Container) error {
 			)
 		}
 
-		switch status {
-		case constants.CONTAINER_STATUS_UP:
-			err = operator.docker.StopContainer(container.ID)
+		// containers which aren't running, including created but never
+		// started ones, are removed by force right away
+		if status == constants.CONTAINER_STATUS_UP {
+			err = operator.docker.StopContainer(ctx, container.ID)
 			if err != nil {
 				return karma.Format(
 					err,
@@ -303,21 +608,52 @@ func (operator *Operator) RemoveContainers(containers []types.Container) error {
 				"docker container successfully stopped, container_id: %s",
 				container.ID,
 			)
-		case constants.CONTAINER_STATUS_EXITED:
-			break
-		default:
+		}
+
+		err = operator.docker.RemoveContainer(ctx, container.ID)
+		if err != nil {
 			return karma.Format(
 				err,
-				"unable to get status of container, container_id: %s",
+				"unable to remove container, container_id: %s",
 				container.ID,
 			)
 		}
 
-		err = operator.docker.RemoveContainer(container.ID)
+		for _, point := range container.Mounts {
+			if point.Type != mount.TypeVolume || point.Name == "" {
+				continue
+			}
+
+			err = operator.docker.RemoveVolume(ctx, point.Name)
+			if err != nil {
+				log.Errorf(
+					err,
+					"unable to remove volume of container, container_id: %s",
+					container.ID,
+				)
+			}
+		}
+
+		operator.mutex.Lock()
+		finished := operator.finishLeasesOfContainer(
+			container.ID, constants.LEASE_OUTCOME_REMOVED,
+		)
+		operator.mutex.Unlock()
+
+		err = operator.saveFinishedLeases(finished)
 		if err != nil {
 			return karma.Format(
 				err,
-				"unable to remove container, container_id: %s",
+				"unable to save leases of removed container, container_id: %s",
+				container.ID,
+			)
+		}
+
+		err = operator.database.RemoveContainer(container.ID, time.Now())
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to mark container as removed, container_id: %s",
 				container.ID,
 			)
 		}
@@ -329,10 +665,18 @@ func (operator *Operator) RemoveContainers(containers []types.Container) error {
 		)
 	}
 
+	operator.notifyReplenisher()
+	operator.notifyQueue()
+
 	return nil
 }
 
-func (operator *Operator) InstallAddonAndSetLicense(bitbucketURL string) error {
+func (operator *Operator) InstallAddonAndSetLicense(
+	ctx context.Context,
+	bitbucketURL string,
+	profile config.Profile,
+	job *job,
+) error {
 	parsedURL, err := url.Parse(bitbucketURL)
 	if err != nil {
 		return karma.Format(
@@ -349,7 +693,11 @@ func (operator *Operator) InstallAddonAndSetLicense(bitbucketURL string) error {
 	)
 
 	log.Info("receiving upm token")
-	token, err := stash.GetUPMToken()
+	var token string
+	err = operator.callWithTimeout(ctx, func() (err error) {
+		token, err = stash.GetUPMToken()
+		return err
+	})
 	if err != nil {
 		return karma.Format(
 			err,
@@ -358,20 +706,28 @@ func (operator *Operator) InstallAddonAndSetLicense(bitbucketURL string) error {
 		)
 	}
 
-	log.Info("installing addon")
-	result, err := stash.InstallAddon(token, operator.opts.AddonPath)
-	if err != nil {
-		return karma.Format(
-			err,
-			"unable to install addon on bitbucket, addon_path: %s",
-			operator.opts.AddonPath,
-		)
-	}
+	job.setPhase(constants.JOB_PHASE_INSTALLING_ADDON)
+	for _, addon := range profile.Addons {
+		log.Infof(nil, "installing addon: %s", addon)
+		var result string
+		err := operator.callWithTimeout(ctx, func() (err error) {
+			result, err = stash.InstallAddon(token, addon)
+			return err
+		})
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to install addon on bitbucket, addon_path: %s",
+				addon,
+			)
+		}
 
-	log.Infof(nil, "addon successfully installed, result: %s", result)
+		log.Infof(nil, "addon successfully installed, result: %s", result)
+	}
 
+	job.setPhase(constants.JOB_PHASE_LICENSING)
 	log.Info("setting license for addon")
-	license, err := readFile(operator.opts.LicensePath)
+	license, err := readFile(profile.License)
 	if err != nil {
 		return karma.Format(
 			err,
@@ -379,12 +735,14 @@ func (operator *Operator) InstallAddonAndSetLicense(bitbucketURL string) error {
 		)
 	}
 
-	err = stash.SetAddonLicense(constants.ADDON_KEY, license)
+	err = operator.callWithTimeout(ctx, func() error {
+		return stash.SetAddonLicense(profile.AddonKey, license)
+	})
 	if err != nil {
 		return karma.Format(
 			err,
 			"unable to set license for addon, license_path: %s",
-			operator.opts.LicensePath,
+			profile.License,
 		)
 	}
 
@@ -393,108 +751,402 @@ func (operator *Operator) InstallAddonAndSetLicense(bitbucketURL string) error {
 	return nil
 }
 
-func (operator *Operator) SetAllocatedStatusForContainer(
-	container types.Container,
-) error {
-	err := operator.docker.SetAllocatedStatusForContainer(container)
+func (operator *Operator) AllocateContainer(
+	ctx context.Context,
+	version string,
+	profileName string,
+	owner string,
+	ttl time.Duration,
+) (*LeasedContainer, error) {
+	startedAt := time.Now()
+
+	pool, err := operator.getPool(version)
 	if err != nil {
-		return karma.Format(
+		return nil, err
+	}
+
+	profile, err := operator.getProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return nil, karma.Format(
 			err,
-			"unable to set allocated status for container, container_id: %s",
-			container.ID,
+			"unable to get containers from docker",
 		)
 	}
-	log.Infof(
-		nil,
-		"status of container set on 'allocated', container_id: %s",
-		container.ID,
+
+	operator.mutex.Lock()
+	if operator.draining {
+		operator.mutex.Unlock()
+		return nil, ErrShuttingDown
+	}
+
+	// queued requests of the pool and profile are served first, in FIFO
+	// order
+	if operator.isQueued(pool.Version, profile.Name) {
+		operator.mutex.Unlock()
+		return nil, ErrRequestsQueued
+	}
+
+	container, err := operator.allocateContainer(
+		containers, *pool, *profile, owner, ttl,
 	)
+	operator.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	err = operator.persistLease(container)
+	if err != nil {
+		return nil, err
+	}
+
+	observeAllocation(
+		pool.Version, constants.ALLOCATION_SOURCE_FREE, startedAt,
+	)
+
+	return container, nil
 }
 
-func (operator *Operator) GetFreeContanier() (*types.Container, error) {
-	containers, err := operator.docker.GetFreeContainers()
+// allocateContainer leases a free running container among given ones in
+// memory only, the lease must be saved by persistLease afterwards, must be
+// called with operator.mutex held.
+func (operator *Operator) allocateContainer(
+	containers []types.Container,
+	pool config.BitbucketPool,
+	profile config.Profile,
+	owner string,
+	ttl time.Duration,
+) (*LeasedContainer, error) {
+	for _, container := range containers {
+		if getPoolOfContainer(container) != pool.Version {
+			continue
+		}
+
+		if container.Labels[constants.LABEL_PROFILE] != profile.Name {
+			continue
+		}
+
+		if operator.isProvisioning(container) {
+			continue
+		}
+
+		if operator.getLeaseByContainerID(container.ID) != nil {
+			continue
+		}
+
+		if handleStatusOfContainer(container.Status) !=
+			constants.CONTAINER_STATUS_UP {
+			continue
+		}
+
+		return operator.leaseContainer(container, owner, ttl)
+	}
+
+	return nil, ErrContainersAllocated
+}
+
+func (operator *Operator) CreateFreeContainer(
+	ctx context.Context,
+	version string,
+	profileName string,
+	owner string,
+	ttl time.Duration,
+) (*LeasedContainer, error) {
+	startedAt := time.Now()
+
+	pool, err := operator.getPool(version)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := operator.getProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	operator.mutex.Lock()
+	draining := operator.draining
+	queued := operator.isQueued(pool.Version, profile.Name)
+	operator.mutex.Unlock()
+
+	if draining {
+		return nil, ErrShuttingDown
+	}
+
+	if queued {
+		return nil, ErrRequestsQueued
+	}
+
+	lease, err := newLease("", owner, operator.getLeaseTTL(ttl))
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to get free container",
+			"unable to create lease",
 		)
 	}
 
-	if len(containers) == 0 {
-		return nil, ErrContainersAllocated
+	name := AddIDToContainerName(operator.config.Prefix)
+
+	container, err := operator.createLeasedContainer(
+		ctx, name, *pool, *profile, lease,
+	)
+	if err != nil {
+		return nil, err
 	}
 
-	// err = operator.docker.SetAllocatedStatusForContainer(containers[0])
-	// if err != nil {
-	// 	return nil, karma.Format(
-	// 		err,
-	// 		"unable to set allocated status for container, container_id: %s",
-	// 		containers[0].ID,
-	// 	)
-	// }
+	observeAllocation(
+		pool.Version, constants.ALLOCATION_SOURCE_PROVISIONED, startedAt,
+	)
 
-	return &containers[0], nil
+	return container, nil
 }
 
-func (operator *Operator) CreateFreeContainer() (*types.Container, error) {
-	container, err := operator.HandleNewContainer()
+// createLeasedContainer provisions a new container which is allocated by
+// given lease right away.
+func (operator *Operator) createLeasedContainer(
+	ctx context.Context,
+	name string,
+	pool config.BitbucketPool,
+	profile config.Profile,
+	lease *database.Lease,
+) (*LeasedContainer, error) {
+	job, err := operator.newJob(ctx, pool, profile)
+	if err != nil {
+		operator.mutex.Lock()
+		delete(operator.provisioning, name)
+		operator.mutex.Unlock()
+
+		return nil, err
+	}
+
+	container, err := operator.provisionContainer(
+		name, pool, profile, lease, job,
+	)
 	if err != nil {
+		operator.mutex.Lock()
+		delete(operator.provisioning, name)
+		operator.mutex.Unlock()
+
 		return nil, karma.Format(
 			err,
 			"unable to handle new container",
 		)
 	}
 
-	err = operator.docker.SetAllocatedStatusForContainer(*container)
+	operator.mutex.Lock()
+	delete(operator.provisioning, name)
+
+	lease.ContainerID = container.ID
+	operator.leases[lease.ID] = lease
+
+	result := *lease
+	operator.mutex.Unlock()
+
+	leased := &LeasedContainer{
+		Container: *container,
+		Lease:     &result,
+	}
+
+	err = operator.persistLease(leased)
+	if err != nil {
+		return nil, err
+	}
+
+	return leased, nil
+}
+
+// leaseContainer must be called with operator.mutex held.
+func (operator *Operator) leaseContainer(
+	container types.Container,
+	owner string,
+	ttl time.Duration,
+) (*LeasedContainer, error) {
+	lease, err := newLease(container.ID, owner, operator.getLeaseTTL(ttl))
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to set allocated status for container, container_id: %s",
+			"unable to create lease, container_id: %s",
 			container.ID,
 		)
 	}
 
-	return container, nil
+	operator.leases[lease.ID] = lease
+
+	result := *lease
+
+	return &LeasedContainer{
+		Container: container,
+		Lease:     &result,
+	}, nil
 }
 
-func (operator *Operator) getBitbucketImageWithVersion() (string, error) {
-	if operator.config.Bitbucket.Version == "latest" {
-		return constants.BITBUCKET_IMAGE + ":latest", nil
+// persistLease saves the lease of the container which has been leased in
+// memory, the lease is dropped if it can't be saved, so the container is
+// free again.
+func (operator *Operator) persistLease(container *LeasedContainer) error {
+	err := operator.writeLease(*container.Lease)
+	if err != nil {
+		operator.mutex.Lock()
+		delete(operator.leases, container.Lease.ID)
+		operator.mutex.Unlock()
+
+		return karma.Format(
+			err,
+			"unable to save lease, container_id: %s",
+			container.ID,
+		)
 	}
 
-	expression := regexp.MustCompile(`^[0-9]([.][0-9])([.][0-9])?$`)
-	if expression.MatchString(operator.config.Bitbucket.Version) {
-		return constants.BITBUCKET_IMAGE +
-			":" +
-			operator.config.Bitbucket.Version, nil
+	operator.notifyReplenisher()
+
+	log.Infof(
+		karma.Describe("lease_id", container.Lease.ID).
+			Describe("owner", container.Lease.Owner).
+			Describe("expires_at", container.Lease.ExpiresAt),
+		"container allocated, container_id: %s",
+		container.ID,
+	)
+
+	return nil
+}
+
+func (operator *Operator) isProvisioning(container types.Container) bool {
+	for _, name := range container.Names {
+		_, ok := operator.provisioning[strings.TrimPrefix(name, "/")]
+		if ok {
+			return true
+		}
 	}
 
-	return "", errors.New("wrong bitbucket version")
+	return false
 }
 
-func (operator *Operator) CreateAndStartContainer() (*docker.ContainerData, error) {
-	result, _, err := operator.isExceedsNumberOfCreatedContainers(
-		constants.MAX_NUMBER_OF_CONTAINERS,
-	)
-	if err != nil {
-		return nil, karma.Format(
-			err,
-			"unable to validate max number of created containers",
-		)
+// holdContainer keeps the existing container in the provisioning set while
+// it's checked or removed, so it can't be allocated meanwhile, must be
+// called with operator.mutex held.
+func (operator *Operator) holdContainer(container types.Container) {
+	operator.provisioning[strings.TrimPrefix(container.Names[0], "/")] =
+		provisioningContainer{
+			pool:    getPoolOfContainer(container),
+			profile: container.Labels[constants.LABEL_PROFILE],
+		}
+}
+
+// unholdContainers removes held containers from the provisioning set, the
+// replenisher is notified since held containers are counted as free.
+func (operator *Operator) unholdContainers(containers []types.Container) {
+	if len(containers) == 0 {
+		return
 	}
 
-	if result {
-		return nil, karma.Describe(
-			"limit", constants.MAX_NUMBER_OF_CONTAINERS,
-		).Reason(
-			errors.New("limit of created containers exceeded"),
+	operator.mutex.Lock()
+	for _, container := range containers {
+		delete(
+			operator.provisioning,
+			strings.TrimPrefix(container.Names[0], "/"),
 		)
 	}
+	operator.mutex.Unlock()
 
+	operator.notifyReplenisher()
+}
+
+func getBitbucketImageWithVersion(image, version string) (string, error) {
+	if version == "latest" {
+		return image + ":latest", nil
+	}
+
+	expression := regexp.MustCompile(`^[0-9]+([.][0-9]+){1,2}$`)
+	if expression.MatchString(version) {
+		return image + ":" + version, nil
+	}
+
+	return "", errors.New("wrong bitbucket version")
+}
+
+// getPool returns the pool of given bitbucket version or the first
+// configured pool if version is empty.
+func (operator *Operator) getPool(
+	version string,
+) (*config.BitbucketPool, error) {
+	if version == "" {
+		return &operator.config.Pools[0], nil
+	}
+
+	for i, pool := range operator.config.Pools {
+		if pool.Version == version {
+			return &operator.config.Pools[i], nil
+		}
+	}
+
+	return nil, karma.Describe("version", version).Reason(ErrUnknownPool)
+}
+
+// getProfile returns the profile of given name with omitted addons and
+// license taken from command line options, empty name stands for the default
+// profile made of the bitbucket settings.
+func (operator *Operator) getProfile(name string) (*config.Profile, error) {
+	profile := config.Profile{
+		Image:                operator.config.Bitbucket.Image,
+		ElasticSearchEnabled: operator.config.Bitbucket.ElasticSearchEnabled,
+		AddonKey:             operator.config.Bitbucket.AddonKey,
+	}
+
+	if name != "" {
+		found := false
+		for _, candidate := range operator.config.Profiles {
+			if candidate.Name == name {
+				profile = candidate
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, karma.Describe("profile", name).
+				Reason(ErrUnknownProfile)
+		}
+	}
+
+	if len(profile.Addons) == 0 {
+		profile.Addons = []string{operator.opts.AddonPath}
+	}
+
+	if profile.License == "" {
+		profile.License = operator.opts.LicensePath
+	}
+
+	return &profile, nil
+}
+
+// getPoolOfContainer returns the pool label of the container, or, for
+// legacy containers, the tag of the container image.
+func getPoolOfContainer(container types.Container) string {
+	if pool, ok := container.Labels[constants.LABEL_POOL]; ok {
+		return pool
+	}
+
+	parts := strings.Split(container.Image, ":")
+	if len(parts) < 2 {
+		return "latest"
+	}
+
+	return parts[len(parts)-1]
+}
+
+func (operator *Operator) CreateAndStartContainer(
+	ctx context.Context,
+	containerName string,
+	pool config.BitbucketPool,
+	profile config.Profile,
+	job *job,
+) (*docker.ContainerData, error) {
 	log.Info("creating container")
-	image, err := operator.getBitbucketImageWithVersion()
+	image, err := getBitbucketImageWithVersion(profile.Image, pool.Version)
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -502,7 +1154,6 @@ func (operator *Operator) CreateAndStartContainer() (*docker.ContainerData, erro
 		)
 	}
 
-	containerName := AddIDToContainerName(operator.config.Prefix)
 	log.Info("receiving free http and ssh ports for new container")
 	portHTTP, portSSH, err := getPorts()
 	if err != nil {
@@ -512,8 +1163,64 @@ func (operator *Operator) CreateAndStartContainer() (*docker.ContainerData, erro
 		)
 	}
 
+	addonHash, err := getFileHash(profile.Addons...)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get hash of addons",
+		)
+	}
+
+	createdAt := time.Now()
+
+	labels := map[string]string{
+		constants.LABEL_MANAGER:    operator.config.Prefix,
+		constants.LABEL_POOL:       pool.Version,
+		constants.LABEL_IMAGE:      image,
+		constants.LABEL_PORT_HTTP:  portHTTP,
+		constants.LABEL_PORT_SSH:   portSSH,
+		constants.LABEL_ADDON_HASH: addonHash,
+		constants.LABEL_CREATED_AT: createdAt.Format(time.RFC3339),
+	}
+
+	if profile.Name != "" {
+		labels[constants.LABEL_PROFILE] = profile.Name
+	}
+
+	jvmArgs := pool.JvmSupportRecommendedArgs
+	if profile.JvmSupportRecommendedArgs != "" {
+		jvmArgs = profile.JvmSupportRecommendedArgs
+	}
+
+	env := []string{
+		"ELASTICSEARCH_ENABLED=" + profile.ElasticSearchEnabled,
+		// "SERVER_PROXY_NAME=" +
+		// 	operator.config.Bitbucket.ServerProxyName,
+		"JVM_SUPPORT_RECOMMENDED_ARGS=" + jvmArgs,
+	}
+
+	var keys []string
+	for key := range profile.Env {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		env = append(env, key+"="+profile.Env[key])
+	}
+
+	job.setPhase(constants.JOB_PHASE_PULLING)
+	err = operator.docker.PullImage(ctx, image, job.setPull)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to pull image",
+		)
+	}
+
 	containerID, err := operator.docker.CreateContainer(
-		containerName, image, portHTTP, portSSH,
+		ctx, containerName, image, portHTTP, portSSH, env, labels,
 	)
 	if err != nil {
 		return nil, karma.Describe(
@@ -524,18 +1231,50 @@ func (operator *Operator) CreateAndStartContainer() (*docker.ContainerData, erro
 		)
 	}
 
+	job.setContainer(containerID)
+
 	container := docker.ContainerData{
-		Name:     containerName,
-		Image:    image,
-		ID:       containerID,
-		Username: operator.config.Bitbucket.Username,
-		Password: operator.config.Bitbucket.Password,
-		PortHTTP: portHTTP,
-		PortSSH:  portSSH,
+		Name:      containerName,
+		Image:     image,
+		ID:        containerID,
+		Username:  operator.config.Bitbucket.Username,
+		Password:  operator.config.Bitbucket.Password,
+		PortHTTP:  portHTTP,
+		PortSSH:   portSSH,
+		Date:      createdAt,
+		Pool:      pool.Version,
+		Profile:   profile.Name,
+		AddonHash: addonHash,
+	}
+
+	err = operator.database.SaveContainer(container)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to save container, container_id: %s",
+			containerID,
+		)
+	}
+
+	if job.isCancelled() {
+		return nil, ErrJobCancelled
+	}
+
+	job.setPhase(constants.JOB_PHASE_STARTING)
+
+	if profile.Seed != "" {
+		err = operator.seedContainer(ctx, containerID, profile.Seed)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to seed container, container_id: %s",
+				containerID,
+			)
+		}
 	}
 
 	log.Info("starting container")
-	err = operator.docker.StartContainer(container.ID)
+	err = operator.docker.StartContainer(ctx, container.ID)
 	if err != nil {
 		return nil, karma.Describe(
 			"container_id", container.ID,
@@ -548,15 +1287,52 @@ func (operator *Operator) CreateAndStartContainer() (*docker.ContainerData, erro
 	return &container, nil
 }
 
+// seedContainer extracts seed tar archive into bitbucket home directory of
+// the container before it's started.
+func (operator *Operator) seedContainer(
+	ctx context.Context,
+	id, path string,
+) error {
+	log.Infof(nil, "seeding container with archive: %s", path)
+	archive, err := os.Open(path)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to open file by path: %s",
+			path,
+		)
+	}
+
+	defer archive.Close()
+
+	return operator.docker.CopyToContainer(
+		ctx, id, constants.BITBUCKET_HOME_PATH, archive,
+	)
+}
+
 func (operator *Operator) ValidateStartupStatus(
+	ctx context.Context,
 	bitbucketURL string,
 	container *docker.ContainerData,
+	job *job,
 ) error {
 	log.Info("validating startup status of a container")
+	job.setPhase(constants.JOB_PHASE_BOOTING)
+	deadline := time.Now().Add(operator.config.Provisioning.StartupTimeout)
 	var message string
 	for {
-		time.Sleep(time.Second)
-		status, err := operator.GetStartupStatus(bitbucketURL)
+		sleep(ctx, time.Second)
+		if job.isCancelled() {
+			return ErrJobCancelled
+		}
+
+		if time.Now().After(deadline) {
+			return karma.Describe(
+				"timeout", operator.config.Provisioning.StartupTimeout,
+			).Reason(ErrStartupTimeout)
+		}
+
+		status, err := operator.GetStartupStatus(ctx, bitbucketURL)
 		if err != nil {
 			return karma.Format(
 				err,
@@ -565,7 +1341,7 @@ func (operator *Operator) ValidateStartupStatus(
 		}
 
 		if status == nil {
-			time.Sleep(time.Second)
+			sleep(ctx, time.Second)
 			continue
 		}
 
@@ -582,20 +1358,31 @@ func (operator *Operator) ValidateStartupStatus(
 			message = status.Progress.Message
 		}
 
+		job.setProgress(status.Progress.Percentage, status.Progress.Message)
+
 		if status.State == constants.CONTAINER_STATUS_STARTED {
 			break
 		}
 
-		time.Sleep(time.Second)
+		sleep(ctx, time.Second)
 	}
 
 	return nil
 }
 
-func (operator *Operator) GetStartupStatus(baseURL string) (*StartupStatus, error) {
+// GetStartupStatus requests the startup status of Bitbucket, nil is returned
+// if Bitbucket doesn't respond yet. The request is limited by
+// timeouts.request.
+func (operator *Operator) GetStartupStatus(
+	ctx context.Context,
+	baseURL string,
+) (*StartupStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, operator.config.Timeouts.Request)
+	defer cancel()
+
 	bitbucketURL := baseURL + "/system/startup"
-	request, err := http.NewRequest(
-		http.MethodGet,
+	request, err := http.NewRequestWithContext(
+		ctx, http.MethodGet,
 		bitbucketURL,
 		nil,
 	)
@@ -625,6 +1412,11 @@ func (operator *Operator) GetStartupStatus(baseURL string) (*StartupStatus, erro
 			if err.Err.Error() == "http: server closed idle connection" {
 				return nil, nil
 			}
+
+			if err.Timeout() && ctx.Err() == context.DeadlineExceeded {
+				// bitbucket is too busy while starting
+				return nil, nil
+			}
 		}
 
 		return nil, karma.Format(
@@ -647,20 +1439,15 @@ func (operator *Operator) GetStartupStatus(baseURL string) (*StartupStatus, erro
 	return &status, nil
 }
 
-func (operator *Operator) GetStatusOfContainerByID(id string) (string, error) {
-	container, err := operator.docker.GetContainerByID(id)
+func (operator *Operator) GetStatusOfContainerByID(
+	ctx context.Context,
+	id string,
+) (string, error) {
+	container, err := operator.getContainer(ctx, id)
 	if err != nil {
 		return "", karma.Format(
 			err,
-			"unable to get containers by id: %s",
-			id,
-		)
-	}
-
-	if container == nil {
-		return "", karma.Format(
-			errors.New("container doesn't found in docker"),
-			"unable to get status container by id: %s",
+			"unable to get container by id: %s",
 			id,
 		)
 	}
@@ -668,15 +1455,14 @@ func (operator *Operator) GetStatusOfContainerByID(id string) (string, error) {
 	return handleStatusOfContainer(container.Status), nil
 }
 
-func (operator *Operator) GetStoppedContainersIDs() ([]string, error) {
-	containers, err := operator.docker.GetContainersListByPrefix(
-		operator.config.Prefix,
-	)
+func (operator *Operator) GetStoppedContainersIDs(
+	ctx context.Context,
+) ([]string, error) {
+	containers, err := operator.getManagedContainers(ctx)
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to get containers by prefix: %s",
-			operator.config.Prefix,
+			"unable to get containers from docker",
 		)
 	}
 
@@ -690,15 +1476,14 @@ func (operator *Operator) GetStoppedContainersIDs() ([]string, error) {
 	return result, nil
 }
 
-func (operator *Operator) GetRunningContainersIDs() ([]string, error) {
-	containers, err := operator.docker.GetContainersListByPrefix(
-		operator.config.Prefix,
-	)
+func (operator *Operator) GetRunningContainersIDs(
+	ctx context.Context,
+) ([]string, error) {
+	containers, err := operator.getManagedContainers(ctx)
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to get containers by prefix: %s",
-			operator.config.Prefix,
+			"unable to get containers from docker",
 		)
 	}
 
@@ -712,30 +1497,122 @@ func (operator *Operator) GetRunningContainersIDs() ([]string, error) {
 	return result, nil
 }
 
-func (operator *Operator) GetAllContaniersFromDocker() ([]types.Container, error) {
-	containers, err := operator.docker.GetContainersListByPrefix(
-		operator.config.Prefix,
-	)
+// getManagedContainers returns containers labeled by this manager together
+// with legacy containers which have their status encoded in the name,
+// quarantined containers are skipped.
+func (operator *Operator) getManagedContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	containers, err := operator.listContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []types.Container
+	for _, container := range containers {
+		if !isQuarantined(container) {
+			result = append(result, container)
+		}
+	}
+
+	return result, nil
+}
+
+// listContainers returns all containers of this manager including
+// quarantined ones.
+func (operator *Operator) listContainers(
+	ctx context.Context,
+) ([]types.Container, error) {
+	containers, err := operator.docker.GetContainers(ctx)
 	if err != nil {
 		return nil, karma.Format(
 			err,
-			"unable to get containers by prefix: %s",
-			operator.config.Prefix,
+			"unable to get labeled containers",
 		)
 	}
 
-	return containers, nil
+	legacy, err := operator.docker.GetLegacyContainers(ctx)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get legacy containers",
+		)
+	}
+
+	return append(containers, legacy...), nil
 }
 
-func (operator *Operator) GetNumberOfContainersByPrefixFromDocker() (int, error) {
-	containers, err := operator.docker.GetContainersListByPrefix(
-		operator.config.Prefix,
-	)
+// getContainer returns container of this manager by its ID, short ID or
+// name, ErrContainerNotFound is returned if there is no such container.
+func (operator *Operator) getContainer(
+	ctx context.Context,
+	id string,
+) (*types.Container, error) {
+	container, err := operator.docker.GetContainerByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if container == nil || !operator.isOwnContainer(*container) {
+		return nil, karma.Describe("container_id", id).
+			Reason(ErrContainerNotFound)
+	}
+
+	return container, nil
+}
+
+// isOwnContainer tells whether the container is labeled by this manager or
+// is a legacy container of this manager.
+func (operator *Operator) isOwnContainer(container types.Container) bool {
+	if prefix, ok := container.Labels[constants.LABEL_MANAGER]; ok {
+		return prefix == operator.config.Prefix
+	}
+
+	for _, name := range container.Names {
+		if strings.Contains(name, operator.config.Prefix) &&
+			strings.Contains(name, "---") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetAllContaniersFromDocker returns the requested page of containers and
+// the number of containers matching the query, quarantined containers are
+// skipped unless states are specified.
+func (operator *Operator) GetAllContaniersFromDocker(
+	ctx context.Context,
+	query ContainerQuery,
+) ([]types.Container, int, error) {
+	if len(query.States) == 0 {
+		query.States = []string{
+			constants.CONTAINER_STATE_FREE,
+			constants.CONTAINER_STATE_LEASED,
+			constants.CONTAINER_STATE_PROVISIONING,
+			constants.CONTAINER_STATE_STOPPED,
+		}
+	}
+
+	containers, total, err := operator.queryContainers(ctx, query)
+	if err != nil {
+		return nil, 0, karma.Format(
+			err,
+			"unable to query containers",
+		)
+	}
+
+	return containers, total, nil
+}
+
+func (operator *Operator) GetNumberOfContainersByPrefixFromDocker(
+	ctx context.Context,
+) (int, error) {
+	containers, err := operator.getManagedContainers(ctx)
 	if err != nil {
 		return 0, karma.Format(
 			err,
-			"unable to get containers by prefix: %s",
-			operator.config.Prefix,
+			"unable to get containers from docker",
 		)
 	}
 
@@ -776,8 +1653,7 @@ func AddIDToContainerName(name string) string {
 	max := 2000000
 	min := 1000000
 	rand.Seed(time.Now().UnixNano())
-	return name + "-" + strconv.Itoa(rand.Intn(max-min)+min) +
-		"---" + constants.NEW_CONTAINER_STATUS
+	return name + "-" + strconv.Itoa(rand.Intn(max-min)+min)
 }
 
 func getFreePort() (string, error) {
@@ -795,10 +1671,22 @@ func getFreePort() (string, error) {
 	return strconv.Itoa(listen.Addr().(*net.TCPAddr).Port), nil
 }
 
-func readFile(path string) (string, error) {
+func getFileHash(paths ...string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		err := hashFile(hash, path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashFile(hash io.Writer, path string) error {
 	file, err := os.Open(path)
 	if err != nil {
-		return "", karma.Format(
+		return karma.Format(
 			err,
 			"unable to open file by path: %s",
 			path,
@@ -807,36 +1695,40 @@ func readFile(path string) (string, error) {
 
 	defer file.Close()
 
-	license, err := ioutil.ReadAll(file)
+	_, err = io.Copy(hash, file)
 	if err != nil {
-		return "", karma.Format(
+		return karma.Format(
 			err,
 			"unable to read file by path: %s",
 			path,
 		)
 	}
 
-	return string(license), nil
+	return nil
 }
 
-func (operator *Operator) isExceedsNumberOfCreatedContainers(
-	max int,
-) (bool, int, error) {
-	containers, err := operator.docker.GetContainersListByPrefix(
-		operator.config.Prefix,
-	)
+func readFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return false, 0, karma.Format(
+		return "", karma.Format(
 			err,
-			"unable to get container list",
+			"unable to open file by path: %s",
+			path,
 		)
 	}
 
-	if len(containers) >= max {
-		return true, 0, nil
+	defer file.Close()
+
+	license, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", karma.Format(
+			err,
+			"unable to read file by path: %s",
+			path,
+		)
 	}
 
-	return false, len(containers), nil
+	return string(license), nil
 }
 
 func handleStatusOfContainer(status string) string {
@@ -848,5 +1740,40 @@ func handleStatusOfContainer(status string) string {
 		return constants.CONTAINER_STATUS_EXITED
 	}
 
+	if strings.Contains(status, constants.CONTAINER_STATUS_CREATED) {
+		return constants.CONTAINER_STATUS_CREATED
+	}
+
 	return constants.CONTAINER_STATUS_UNKNOWN
 }
+
+// sleep waits for given duration or until ctx is done.
+func sleep(ctx context.Context, duration time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// callWithTimeout limits the call to Bitbucket REST API, which doesn't accept
+// context, by timeouts.request and ctx, the call is abandoned once either is
+// done.
+func (operator *Operator) callWithTimeout(
+	ctx context.Context,
+	call func() error,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, operator.config.Timeouts.Request)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
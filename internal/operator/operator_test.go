@@ -0,0 +1,321 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+func TestHandleStatusOfContainer(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"Up 5 minutes", constants.CONTAINER_STATUS_UP},
+		{"Up 2 hours (healthy)", constants.CONTAINER_STATUS_UP},
+		{"Exited (137) 3 seconds ago", constants.CONTAINER_STATUS_EXITED},
+		{"Created", constants.CONTAINER_STATUS_CREATED},
+		{"Restarting (1) 2 seconds ago", constants.CONTAINER_STATUS_UNKNOWN},
+		{"", constants.CONTAINER_STATUS_UNKNOWN},
+	}
+
+	for _, test := range tests {
+		got := handleStatusOfContainer(test.status)
+		if got != test.want {
+			t.Errorf(
+				"handleStatusOfContainer(%q) = %q, want %q",
+				test.status, got, test.want,
+			)
+		}
+	}
+}
+
+func TestRollbackContainer(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		stopped bool
+	}{
+		{"created but not started", "Created", false},
+		{"running", "Up 5 minutes", true},
+		{"exited", "Exited (1) 1 second ago", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := newFakeDocker(newTestContainer("c1", test.status, 0))
+			operator := newTestOperator(docker, newFakeDatabase())
+
+			job := newDetachedJob(context.Background())
+			job.status.ContainerID = "c1"
+
+			operator.rollbackContainer(job, errors.New("unable to start"))
+
+			if len(docker.removed) != 1 || docker.removed[0] != "c1" {
+				t.Fatalf("container is not removed, removed: %v", docker.removed)
+			}
+
+			if stopped := len(docker.stopped) > 0; stopped != test.stopped {
+				t.Errorf("stopped = %v, want %v", stopped, test.stopped)
+			}
+		})
+	}
+}
+
+func TestContainerLookupNotFound(t *testing.T) {
+	foreign := newTestContainer("foreign", "Up 5 minutes", 0)
+	foreign.Labels[constants.LABEL_MANAGER] = "other"
+
+	docker := newFakeDocker(
+		newTestContainer("own", "Up 5 minutes", 0),
+		foreign,
+	)
+	operator := newTestOperator(docker, newFakeDatabase())
+	ctx := context.Background()
+
+	lookups := map[string]func(id string) error{
+		"GetContainerByID": func(id string) error {
+			_, err := operator.GetContainerByID(ctx, id)
+			return err
+		},
+		"GetLeasesOfContainer": func(id string) error {
+			_, err := operator.GetLeasesOfContainer(ctx, id)
+			return err
+		},
+		"SubscribeContainer": func(id string) error {
+			_, err := operator.SubscribeContainer(ctx, id)
+			return err
+		},
+		"RenewLease": func(id string) error {
+			_, err := operator.RenewLease(ctx, id, time.Hour)
+			return err
+		},
+		"ReleaseContainer": func(id string) error {
+			_, err := operator.ReleaseContainer(ctx, id, false)
+			return err
+		},
+		"GetInstance": func(id string) error {
+			_, err := operator.GetInstance(ctx, id)
+			return err
+		},
+	}
+
+	for name, lookup := range lookups {
+		for _, id := range []string{"unknown", "foreign", ""} {
+			err := lookup(id)
+			if GetErrorKind(err) != constants.ERROR_KIND_NOT_FOUND {
+				t.Errorf("%s(%q) = %v, want not found", name, id, err)
+			}
+
+			if !karma.Contains(err, ErrContainerNotFound) {
+				t.Errorf("%s(%q) = %v, want ErrContainerNotFound", name, id, err)
+			}
+		}
+	}
+
+	_, err := operator.GetContainerByID(ctx, "own")
+	if err != nil {
+		t.Errorf("GetContainerByID(own) = %v", err)
+	}
+}
+
+func TestAllocateContainer(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		profile    string
+		saveErr    error
+		wantErr    error
+		wantLeased bool
+	}{
+		{
+			name:       "free container",
+			status:     "Up 5 minutes",
+			wantLeased: true,
+		},
+		{
+			name:    "lease can't be saved",
+			status:  "Up 5 minutes",
+			saveErr: errors.New("database is down"),
+		},
+		{
+			name:    "stopped container",
+			status:  "Exited (0) 5 minutes ago",
+			wantErr: ErrContainersAllocated,
+		},
+		{
+			name:    "no container of profile",
+			status:  "Up 5 minutes",
+			profile: "mirror",
+			wantErr: ErrContainersAllocated,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := newFakeDocker(newTestContainer("c1", test.status, 0))
+			db := newFakeDatabase()
+			db.saveLeaseErr = test.saveErr
+
+			operator := newTestOperator(docker, db)
+			operator.config.Profiles = append(
+				operator.config.Profiles,
+				config.Profile{Name: "mirror"},
+			)
+
+			container, err := operator.AllocateContainer(
+				context.Background(), "", test.profile, "ci", 0,
+			)
+
+			switch {
+			case test.wantErr != nil:
+				if !karma.Contains(err, test.wantErr) {
+					t.Fatalf("err = %v, want %v", err, test.wantErr)
+				}
+			case test.saveErr != nil:
+				if err == nil {
+					t.Fatalf("err = nil, want error")
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			leased := operator.getLeaseByContainerID("c1") != nil
+			if leased != test.wantLeased {
+				t.Errorf("leased = %v, want %v", leased, test.wantLeased)
+			}
+
+			if test.wantLeased {
+				if container.Lease.Owner != "ci" {
+					t.Errorf("owner = %q, want ci", container.Lease.Owner)
+				}
+
+				if _, ok := db.leases[container.Lease.ID]; !ok {
+					t.Errorf("lease is not saved")
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateContainerListsWithoutMutex(t *testing.T) {
+	docker := newFakeDocker(newTestContainer("c1", "Up 5 minutes", 0))
+	operator := newTestOperator(docker, newFakeDatabase())
+
+	// listing would deadlock if docker were called with the mutex held
+	docker.onList = func() {
+		operator.mutex.Lock()
+		operator.mutex.Unlock()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := operator.AllocateContainer(
+			context.Background(), "", "", "", 0,
+		)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("docker is called with operator.mutex held")
+	}
+}
+
+func TestCleanAllocatedContainers(t *testing.T) {
+	tests := []struct {
+		name string
+		// during is called while the cleaner works with the mutex released
+		during      func(t *testing.T, operator *Operator, docker *fakeDocker)
+		wantRemoved bool
+	}{
+		{
+			name:        "expired lease",
+			wantRemoved: true,
+		},
+		{
+			name: "lease renewed while containers are listed",
+			during: func(t *testing.T, operator *Operator, docker *fakeDocker) {
+				docker.onGetByIDs = func() {
+					_, err := operator.RenewLease(
+						context.Background(), "c1", time.Hour,
+					)
+					if err != nil {
+						t.Errorf("unable to renew lease: %s", err)
+					}
+				}
+			},
+		},
+		{
+			name: "container allocated while removed",
+			during: func(t *testing.T, operator *Operator, docker *fakeDocker) {
+				docker.onRemove = func() {
+					_, err := operator.AllocateContainer(
+						context.Background(), "", "", "ci", 0,
+					)
+					if !karma.Contains(err, ErrContainersAllocated) {
+						t.Errorf(
+							"err = %v, want %v",
+							err, ErrContainersAllocated,
+						)
+					}
+				}
+			},
+			wantRemoved: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := newFakeDocker(newTestContainer("c1", "Up 5 minutes", 0))
+			db := newFakeDatabase()
+			db.leases["l1"] = database.Lease{
+				ID:          "l1",
+				ContainerID: "c1",
+				ExpiresAt:   time.Now().Add(-time.Minute),
+			}
+
+			operator := newTestOperator(docker, db)
+
+			err := operator.RestoreState(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.during != nil {
+				test.during(t, operator, docker)
+			}
+
+			err = operator.CleanAllocatedContainers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			removed := len(docker.removed) == 1
+			if removed != test.wantRemoved {
+				t.Errorf(
+					"removed = %v, want %v", docker.removed, test.wantRemoved,
+				)
+			}
+
+			leased := operator.getLeaseByContainerID("c1") != nil
+			if leased == test.wantRemoved {
+				t.Errorf("leased = %v, want %v", leased, !test.wantRemoved)
+			}
+
+			if len(operator.provisioning) != 0 {
+				t.Errorf("provisioning = %v, want empty", operator.provisioning)
+			}
+		})
+	}
+}
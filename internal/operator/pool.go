@@ -0,0 +1,217 @@
+package operator
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+// ReplenishNotifications receives every time a container is allocated or
+// removed, so the pool should be replenished.
+func (operator *Operator) ReplenishNotifications() <-chan struct{} {
+	return operator.replenish
+}
+
+// ReplenishPool reserves containers until every pool has the configured
+// minimum of free containers, reserved containers are provisioned in
+// background.
+func (operator *Operator) ReplenishPool(ctx context.Context) error {
+	for {
+		version, missing, err := operator.getMissingContainers(ctx)
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to get number of missing free containers",
+			)
+		}
+
+		if missing == 0 {
+			return nil
+		}
+
+		log.Infof(
+			karma.Describe("version", version),
+			"replenishing pool, missing free containers: %d",
+			missing,
+		)
+
+		for i := 0; i < missing; i++ {
+			err := operator.startFreeContainer(ctx, version)
+			if err != nil {
+				return karma.Format(
+					err,
+					"unable to start provisioning of free container",
+				)
+			}
+		}
+	}
+}
+
+// startFreeContainer reserves a container of the default profile for the
+// pool and provisions it in background.
+func (operator *Operator) startFreeContainer(
+	ctx context.Context,
+	version string,
+) error {
+	pool, err := operator.getPool(version)
+	if err != nil {
+		return err
+	}
+
+	profile, err := operator.getProfile("")
+	if err != nil {
+		return err
+	}
+
+	name := AddIDToContainerName(operator.config.Prefix)
+
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	operator.mutex.Lock()
+	err = operator.reserveContainer(containers, name, *pool, *profile, nil)
+	operator.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	job, err := operator.newJob(context.Background(), *pool, *profile)
+	if err != nil {
+		operator.mutex.Lock()
+		delete(operator.provisioning, name)
+		operator.mutex.Unlock()
+
+		return err
+	}
+
+	go func() {
+		_, err := operator.handleNewContainer(name, job, *pool, *profile)
+		if err != nil {
+			log.Errorf(
+				err,
+				"unable to provision free container, job_id: %s",
+				job.status.ID,
+			)
+		}
+	}()
+
+	return nil
+}
+
+type poolUsage struct {
+	total int
+	free  int
+}
+
+// getMissingContainers returns the version of the first pool which lacks
+// free containers and how many containers should be provisioned for it,
+// containers which are being provisioned for pools are counted as free ones.
+// Only containers of the default profile are kept free, containers of named
+// profiles are provisioned on demand. Nothing is provisioned once the
+// operator is draining.
+func (operator *Operator) getMissingContainers(
+	ctx context.Context,
+) (string, int, error) {
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return "", 0, karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if operator.draining {
+		return "", 0, nil
+	}
+
+	total, usages := operator.getPoolUsages(containers)
+
+	for _, pool := range operator.config.Pools {
+		usage := usages[pool.Version]
+
+		missing := pool.MinFree - usage.free
+		if missing > pool.MaxTotal-usage.total {
+			missing = pool.MaxTotal - usage.total
+		}
+
+		if missing > operator.config.Pool.MaxTotal-total {
+			missing = operator.config.Pool.MaxTotal - total
+		}
+
+		if missing > 0 {
+			return pool.Version, missing, nil
+		}
+	}
+
+	return "", 0, nil
+}
+
+// getPoolUsages returns the total number of given containers and usage of
+// every configured pool including containers being provisioned, must be
+// called with operator.mutex held.
+func (operator *Operator) getPoolUsages(
+	containers []types.Container,
+) (int, map[string]*poolUsage) {
+	total := 0
+	usages := map[string]*poolUsage{}
+	for _, pool := range operator.config.Pools {
+		usages[pool.Version] = &poolUsage{}
+	}
+
+	count := func(pool string, free bool) {
+		total++
+
+		usage, ok := usages[pool]
+		if !ok {
+			return
+		}
+
+		usage.total++
+		if free {
+			usage.free++
+		}
+	}
+
+	for _, container := range operator.provisioning {
+		count(
+			container.pool,
+			container.profile == "" && container.lease == nil,
+		)
+	}
+
+	for _, container := range containers {
+		if operator.isProvisioning(container) {
+			continue
+		}
+
+		// stopped containers are counted against limits, but can't be
+		// allocated
+		count(
+			getPoolOfContainer(container),
+			container.Labels[constants.LABEL_PROFILE] == "" &&
+				operator.getLeaseByContainerID(container.ID) == nil &&
+				handleStatusOfContainer(container.Status) ==
+					constants.CONTAINER_STATUS_UP,
+		)
+	}
+
+	return total, usages
+}
+
+func (operator *Operator) notifyReplenisher() {
+	select {
+	case operator.replenish <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,60 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+func TestGetPoolUsages(t *testing.T) {
+	profiled := newTestContainer("profiled", "Up 5 minutes", 0)
+	profiled.Labels[constants.LABEL_PROFILE] = "mirror"
+
+	other := newTestContainer("other", "Up 5 minutes", 0)
+	other.Labels[constants.LABEL_POOL] = "7.6.0"
+
+	containers := []types.Container{
+		newTestContainer("free", "Up 5 minutes", 0),
+		newTestContainer("leased", "Up 5 minutes", 0),
+		newTestContainer("stopped", "Exited (0) 5 minutes ago", 0),
+		newTestContainer("created", "Created", 0),
+		profiled,
+		other,
+	}
+
+	operator := newTestOperator(newFakeDocker(), newFakeDatabase())
+	operator.leases["lease"] = &database.Lease{
+		ID:          "lease",
+		ContainerID: "leased",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	operator.provisioning["booting"] = provisioningContainer{pool: "6.8.0"}
+
+	total, usages := operator.getPoolUsages(containers)
+
+	if total != 7 {
+		t.Errorf("total = %d, want 7", total)
+	}
+
+	tests := []struct {
+		pool  string
+		total int
+		free  int
+	}{
+		{"6.8.0", 6, 2},
+		{"7.6.0", 1, 1},
+	}
+
+	for _, test := range tests {
+		usage := usages[test.pool]
+		if usage.total != test.total || usage.free != test.free {
+			t.Errorf(
+				"%s: usage = %+v, want total %d and free %d",
+				test.pool, *usage, test.total, test.free,
+			)
+		}
+	}
+}
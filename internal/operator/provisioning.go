@@ -0,0 +1,154 @@
+package operator
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+// reserveContainer registers the name in the provisioning set if limits allow
+// one more container in the pool, must be called with operator.mutex held.
+// Reserved containers are counted against limits, so concurrent provisioning
+// can't exceed them. Containers are listed by the caller before the mutex is
+// taken, so docker isn't called with the mutex held.
+func (operator *Operator) reserveContainer(
+	containers []types.Container,
+	name string,
+	pool config.BitbucketPool,
+	profile config.Profile,
+	lease *database.Lease,
+) error {
+	total, usages := operator.getPoolUsages(containers)
+
+	if total >= operator.config.Pool.MaxTotal {
+		return karma.Describe(
+			"limit", operator.config.Pool.MaxTotal,
+		).Reason(ErrLimitExceeded)
+	}
+
+	if usage, ok := usages[pool.Version]; ok && usage.total >= pool.MaxTotal {
+		return karma.Describe("limit", pool.MaxTotal).
+			Describe("version", pool.Version).
+			Reason(ErrLimitExceeded)
+	}
+
+	operator.provisioning[name] = provisioningContainer{
+		pool:    pool.Version,
+		profile: profile.Name,
+		lease:   lease,
+	}
+
+	return nil
+}
+
+// acquireSlot waits for one of provisioning.concurrency slots and for enough
+// available memory, waiting is stopped if the job is cancelled.
+func (operator *Operator) acquireSlot(job *job) error {
+	select {
+	case operator.slots <- struct{}{}:
+	case <-job.ctx.Done():
+		return ErrJobCancelled
+	}
+
+	err := operator.waitForMemory(job)
+	if err != nil {
+		operator.releaseSlot()
+		return err
+	}
+
+	return nil
+}
+
+func (operator *Operator) releaseSlot() {
+	<-operator.slots
+}
+
+func (operator *Operator) waitForMemory(job *job) error {
+	required := operator.config.Provisioning.MinAvailableMemoryMB
+	if required == 0 {
+		return nil
+	}
+
+	waiting := false
+	for {
+		available, err := getAvailableMemoryMB()
+		if err != nil {
+			log.Warningf(
+				err,
+				"unable to get available memory, memory guard is skipped",
+			)
+			return nil
+		}
+
+		if available >= required {
+			return nil
+		}
+
+		if !waiting {
+			log.Warningf(
+				nil,
+				"waiting for memory to provision container, "+
+					"available: %d MiB, required: %d MiB",
+				available,
+				required,
+			)
+			waiting = true
+		}
+
+		sleep(job.ctx, 5*time.Second)
+
+		if job.isCancelled() {
+			return ErrJobCancelled
+		}
+	}
+}
+
+func getAvailableMemoryMB() (int, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, karma.Format(
+			err,
+			"unable to open /proc/meminfo",
+		)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kilobytes, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, karma.Format(
+				err,
+				"unable to parse available memory: %s",
+				fields[1],
+			)
+		}
+
+		return kilobytes / 1024, nil
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return 0, karma.Format(
+			err,
+			"unable to read /proc/meminfo",
+		)
+	}
+
+	return 0, errors.New("MemAvailable is not found in /proc/meminfo")
+}
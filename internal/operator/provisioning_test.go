@@ -0,0 +1,167 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProvisioningLimits(t *testing.T) {
+	// stopped containers are counted against limits, so there is room for
+	// three more containers in total and for one more of 6.8.0
+	docker := newFakeDocker()
+	for i := 0; i < 3; i++ {
+		container := newTestContainer(
+			fmt.Sprintf("c%d", i), "Exited (0) 5 minutes ago", 0,
+		)
+		docker.containers[container.ID] = container
+	}
+
+	// every container fails to start and is rolled back, so provisioning
+	// never stops until limits are reached
+	docker.startErr = errors.New("unable to start container")
+
+	operator := newTestOperator(docker, newFakeDatabase())
+	operator.config.Bitbucket.Image = "atlassian/bitbucket-server"
+	operator.config.Pools[0].MaxTotal = 4
+	operator.config.Pools[1].MinFree = 2
+
+	operator.opts.AddonPath = filepath.Join(t.TempDir(), "addon.jar")
+	err := ioutil.WriteFile(operator.opts.AddonPath, []byte("addon"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	var (
+		mutex  sync.Mutex
+		active int
+		max    int
+	)
+
+	docker.onCreate = func() {
+		containers, _ := docker.GetContainers(ctx)
+
+		operator.mutex.Lock()
+		total, usages := operator.getPoolUsages(containers)
+		operator.mutex.Unlock()
+
+		if total > operator.config.Pool.MaxTotal {
+			t.Errorf(
+				"total = %d, want at most %d",
+				total, operator.config.Pool.MaxTotal,
+			)
+		}
+
+		for _, pool := range operator.config.Pools {
+			usage := usages[pool.Version]
+			if usage.total > pool.MaxTotal {
+				t.Errorf(
+					"total of pool %s = %d, want at most %d",
+					pool.Version, usage.total, pool.MaxTotal,
+				)
+			}
+		}
+
+		mutex.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+	}
+
+	docker.onRemove = func() {
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+	}
+
+	for i := 0; i < 4; i++ {
+		_, err := operator.Enqueue(
+			operator.config.Pools[i%2].Version, "", "queued", 0,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		version := operator.config.Pools[i%2].Version
+
+		group.Add(1)
+		go func() {
+			defer group.Done()
+
+			for j := 0; j < 5; j++ {
+				operator.CreateFreeContainer(ctx, version, "", "created", 0)
+			}
+		}()
+	}
+
+	group.Add(2)
+	go func() {
+		defer group.Done()
+
+		for i := 0; i < 20; i++ {
+			operator.ServeQueue(ctx)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	go func() {
+		defer group.Done()
+
+		for i := 0; i < 20; i++ {
+			operator.ReplenishPool(ctx)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	group.Wait()
+
+	// containers of the queue and the replenisher are provisioned in
+	// background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		operator.mutex.Lock()
+		provisioning := len(operator.provisioning)
+		operator.mutex.Unlock()
+
+		if provisioning == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("provisioning = %d containers, want none", provisioning)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(operator.slots) != 0 {
+		t.Errorf("slots = %d, want all released", len(operator.slots))
+	}
+
+	if docker.created == 0 {
+		t.Errorf("no containers were provisioned")
+	}
+
+	limit := operator.config.Provisioning.Concurrency
+	if max > limit {
+		t.Errorf("containers provisioned at once = %d, want at most %d", max, limit)
+	}
+
+	if len(docker.containers) != 3 {
+		t.Errorf("containers = %d, want 3", len(docker.containers))
+	}
+}
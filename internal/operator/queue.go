@@ -0,0 +1,489 @@
+package operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
+)
+
+var (
+	ErrTicketNotFound = NewError(
+		constants.ERROR_KIND_NOT_FOUND,
+		"queue ticket not found",
+	)
+	ErrRequestsQueued = NewError(
+		constants.ERROR_KIND_CAPACITY_EXHAUSTED,
+		"allocation requests are queued",
+	)
+)
+
+// Ticket describes allocation request waiting in the queue, container is
+// set once the request is served.
+type Ticket struct {
+	ID        string           `json:"id"`
+	Position  int              `json:"position,omitempty"`
+	Container *LeasedContainer `json:"container,omitempty"`
+}
+
+type waiter struct {
+	id        string
+	pool      config.BitbucketPool
+	profile   config.Profile
+	owner     string
+	ttl       time.Duration
+	queuedAt  time.Time
+	expiresAt time.Time
+
+	// serving is set while a container is being provisioned for the waiter
+	// or the lease of allocated container is being saved
+	serving   bool
+	cancelled bool
+	container *LeasedContainer
+	err       error
+	done      chan struct{}
+}
+
+// isQueued tells whether a request for the pool and profile waits in the
+// queue, requests which are being served or expired aren't counted, must be
+// called with operator.mutex held.
+func (operator *Operator) isQueued(pool string, profile string) bool {
+	now := time.Now()
+	for _, waiter := range operator.queue {
+		if waiter.serving || waiter.cancelled || now.After(waiter.expiresAt) {
+			continue
+		}
+
+		if waiter.pool.Version == pool && waiter.profile.Name == profile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueueNotifications receives every time a container is released, removed
+// or provisioned, so queued requests may be served.
+func (operator *Operator) QueueNotifications() <-chan struct{} {
+	return operator.dequeue
+}
+
+func (operator *Operator) Enqueue(
+	version string,
+	profileName string,
+	owner string,
+	ttl time.Duration,
+) (*Ticket, error) {
+	pool, err := operator.getPool(version)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := operator.getProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateID()
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to generate ticket id",
+		)
+	}
+
+	waiter := &waiter{
+		id:        id,
+		pool:      *pool,
+		profile:   *profile,
+		owner:     owner,
+		ttl:       ttl,
+		queuedAt:  time.Now(),
+		expiresAt: time.Now().Add(operator.config.Queue.Timeout),
+		done:      make(chan struct{}),
+	}
+
+	operator.mutex.Lock()
+	if operator.draining {
+		operator.mutex.Unlock()
+		return nil, ErrShuttingDown
+	}
+
+	operator.waiters[id] = waiter
+	operator.queue = append(operator.queue, waiter)
+	position := len(operator.queue)
+	operator.mutex.Unlock()
+
+	log.Infof(
+		karma.Describe("ticket", id).
+			Describe("owner", owner),
+		"allocation request queued, position: %d",
+		position,
+	)
+
+	operator.notifyQueue()
+
+	return &Ticket{
+		ID:       id,
+		Position: position,
+	}, nil
+}
+
+// WaitInQueue waits until the queued request is served, timeout passes or
+// ctx is done, if the request is still waiting the ticket is returned with
+// its current position.
+func (operator *Operator) WaitInQueue(
+	ctx context.Context,
+	id string,
+	timeout time.Duration,
+) (*Ticket, error) {
+	operator.mutex.Lock()
+	waiter, ok := operator.waiters[id]
+	if !ok {
+		operator.mutex.Unlock()
+		return nil, ErrTicketNotFound
+	}
+
+	waiter.expiresAt = time.Now().Add(timeout + operator.config.Queue.Timeout)
+	operator.mutex.Unlock()
+
+	select {
+	case <-waiter.done:
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+
+	operator.mutex.Lock()
+	defer operator.mutex.Unlock()
+
+	if !isServed(waiter) {
+		return &Ticket{
+			ID:       id,
+			Position: operator.getPosition(waiter),
+		}, nil
+	}
+
+	delete(operator.waiters, id)
+
+	if waiter.err != nil {
+		return nil, waiter.err
+	}
+
+	return &Ticket{
+		ID:        id,
+		Container: waiter.container,
+	}, nil
+}
+
+func (operator *Operator) CancelTicket(ctx context.Context, id string) error {
+	operator.mutex.Lock()
+	waiter, ok := operator.waiters[id]
+	if !ok {
+		operator.mutex.Unlock()
+		return ErrTicketNotFound
+	}
+
+	container := operator.dropWaiter(waiter, ErrTicketNotFound)
+	operator.mutex.Unlock()
+
+	log.Infof(nil, "allocation request cancelled, ticket: %s", id)
+
+	if container != nil {
+		operator.releaseAbandoned(ctx, []*LeasedContainer{container})
+	}
+
+	return nil
+}
+
+// ServeQueue serves queued allocation requests in FIFO order, requests which
+// are not polled for queue.timeout are dropped.
+func (operator *Operator) ServeQueue(ctx context.Context) error {
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	operator.mutex.Lock()
+
+	abandoned := operator.dropExpiredWaiters()
+
+	var served []*waiter
+	for _, waiter := range append([]*waiter{}, operator.queue...) {
+		if waiter.serving {
+			continue
+		}
+
+		var container *LeasedContainer
+		container, err = operator.allocateContainer(
+			containers, waiter.pool, waiter.profile, waiter.owner, waiter.ttl,
+		)
+		if err == nil {
+			waiter.serving = true
+			waiter.container = container
+			served = append(served, waiter)
+			continue
+		}
+
+		if err != ErrContainersAllocated {
+			err = karma.Format(
+				err,
+				"unable to allocate container for queued request",
+			)
+			break
+		}
+
+		err = operator.scheduleProvisioning(containers, waiter)
+		if err != nil {
+			err = karma.Format(
+				err,
+				"unable to provision container for queued request",
+			)
+			break
+		}
+	}
+
+	operator.mutex.Unlock()
+
+	for _, waiter := range served {
+		container := waiter.container
+
+		saveErr := operator.persistLease(container)
+
+		operator.mutex.Lock()
+		waiter.serving = false
+		waiter.container = nil
+
+		switch {
+		case saveErr != nil:
+			if err == nil {
+				err = karma.Format(
+					saveErr,
+					"unable to allocate container for queued request",
+				)
+			}
+		case waiter.cancelled:
+			abandoned = append(abandoned, container)
+		default:
+			operator.finishWaiter(waiter, container, nil)
+		}
+		operator.mutex.Unlock()
+	}
+
+	operator.releaseAbandoned(ctx, abandoned)
+
+	return err
+}
+
+// scheduleProvisioning starts provisioning of a new container for the
+// waiter if limits allow it, must be called with operator.mutex held.
+func (operator *Operator) scheduleProvisioning(
+	containers []types.Container,
+	waiter *waiter,
+) error {
+	lease, err := newLease("", waiter.owner, operator.getLeaseTTL(waiter.ttl))
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to create lease",
+		)
+	}
+
+	name := AddIDToContainerName(operator.config.Prefix)
+
+	// reserved right away, so following requests take this container into
+	// account while checking limits
+	err = operator.reserveContainer(
+		containers, name, waiter.pool, waiter.profile, lease,
+	)
+	if karma.Contains(err, ErrLimitExceeded) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	waiter.serving = true
+
+	go operator.provisionForWaiter(waiter, name, lease)
+
+	return nil
+}
+
+func (operator *Operator) provisionForWaiter(
+	waiter *waiter,
+	name string,
+	lease *database.Lease,
+) {
+	ctx := context.Background()
+
+	container, err := operator.createLeasedContainer(
+		ctx, name, waiter.pool, waiter.profile, lease,
+	)
+
+	operator.mutex.Lock()
+	waiter.serving = false
+
+	if waiter.cancelled {
+		operator.mutex.Unlock()
+
+		if container != nil {
+			operator.releaseAbandoned(ctx, []*LeasedContainer{container})
+		}
+
+		return
+	}
+
+	if karma.Contains(err, ErrLimitExceeded) {
+		operator.mutex.Unlock()
+
+		log.Warningf(
+			err,
+			"unable to provision container for queued request, ticket: %s",
+			waiter.id,
+		)
+
+		return
+	}
+
+	operator.finishWaiter(waiter, container, err)
+	operator.mutex.Unlock()
+}
+
+// finishWaiter must be called with operator.mutex held.
+func (operator *Operator) finishWaiter(
+	waiter *waiter,
+	container *LeasedContainer,
+	err error,
+) {
+	operator.removeFromQueue(waiter)
+
+	waiter.container = container
+	waiter.err = err
+	waiter.expiresAt = time.Now().Add(operator.config.Queue.Timeout)
+	close(waiter.done)
+
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to serve queued request, ticket: %s",
+			waiter.id,
+		)
+		return
+	}
+
+	observeAllocation(
+		waiter.pool.Version, constants.ALLOCATION_SOURCE_QUEUED,
+		waiter.queuedAt,
+	)
+
+	log.Infof(
+		karma.Describe("ticket", waiter.id),
+		"queued request served, container_id: %s",
+		container.ID,
+	)
+}
+
+// dropWaiter removes the waiter from the queue and returns container which
+// it has been served with, if any, the waiting request gets given reason,
+// must be called with operator.mutex held.
+func (operator *Operator) dropWaiter(
+	waiter *waiter,
+	reason error,
+) *LeasedContainer {
+	delete(operator.waiters, waiter.id)
+
+	if isServed(waiter) {
+		return waiter.container
+	}
+
+	operator.removeFromQueue(waiter)
+
+	waiter.cancelled = true
+	waiter.err = reason
+	close(waiter.done)
+
+	return nil
+}
+
+// dropExpiredWaiters must be called with operator.mutex held.
+func (operator *Operator) dropExpiredWaiters() []*LeasedContainer {
+	var abandoned []*LeasedContainer
+
+	now := time.Now()
+	for _, waiter := range operator.waiters {
+		if now.Before(waiter.expiresAt) {
+			continue
+		}
+
+		log.Infof(nil, "dropping abandoned ticket: %s", waiter.id)
+
+		container := operator.dropWaiter(waiter, ErrTicketNotFound)
+		if container != nil {
+			abandoned = append(abandoned, container)
+		}
+	}
+
+	return abandoned
+}
+
+func (operator *Operator) releaseAbandoned(
+	ctx context.Context,
+	containers []*LeasedContainer,
+) {
+	for _, container := range containers {
+		_, err := operator.ReleaseContainer(ctx, container.ID, false)
+		if err != nil && err != ErrContainerNotAllocated {
+			log.Errorf(
+				err,
+				"unable to release container of abandoned ticket, container_id: %s",
+				container.ID,
+			)
+		}
+	}
+}
+
+// removeFromQueue must be called with operator.mutex held.
+func (operator *Operator) removeFromQueue(waiter *waiter) {
+	for i, queued := range operator.queue {
+		if queued == waiter {
+			operator.queue = append(operator.queue[:i], operator.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// getPosition must be called with operator.mutex held.
+func (operator *Operator) getPosition(waiter *waiter) int {
+	for i, queued := range operator.queue {
+		if queued == waiter {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+func isServed(waiter *waiter) bool {
+	select {
+	case <-waiter.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (operator *Operator) notifyQueue() {
+	select {
+	case operator.dequeue <- struct{}{}:
+	default:
+	}
+}
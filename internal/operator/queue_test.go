@@ -0,0 +1,185 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+func TestServeQueueFIFO(t *testing.T) {
+	docker := newFakeDocker()
+	operator := newTestOperator(docker, newFakeDatabase())
+	operator.config.Pool.MaxTotal = 0
+
+	var tickets []*Ticket
+	for _, owner := range []string{"first", "second", "third"} {
+		ticket, err := operator.Enqueue("", "", owner, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ticket.Position != len(tickets)+1 {
+			t.Errorf("position = %d, want %d", ticket.Position, len(tickets)+1)
+		}
+
+		tickets = append(tickets, ticket)
+	}
+
+	ctx := context.Background()
+
+	_, err := operator.AllocateContainer(ctx, "", "", "newcomer", 0)
+	if !karma.Contains(err, ErrRequestsQueued) {
+		t.Fatalf("AllocateContainer() = %v, want ErrRequestsQueued", err)
+	}
+
+	_, err = operator.CreateFreeContainer(ctx, "", "", "newcomer", 0)
+	if !karma.Contains(err, ErrRequestsQueued) {
+		t.Fatalf("CreateFreeContainer() = %v, want ErrRequestsQueued", err)
+	}
+
+	for i, id := range []string{"c1", "c2"} {
+		docker.containers[id] = newTestContainer(id, "Up 5 minutes", int64(i))
+	}
+
+	err = operator.ServeQueue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{"first", "second"} {
+		ticket, err := operator.WaitInQueue(ctx, tickets[i].ID, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ticket.Container == nil {
+			t.Fatalf("ticket of %s is not served", want)
+		}
+
+		if ticket.Container.Lease.Owner != want {
+			t.Errorf("owner = %q, want %q", ticket.Container.Lease.Owner, want)
+		}
+	}
+
+	ticket, err := operator.WaitInQueue(ctx, tickets[2].ID, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ticket.Container != nil || ticket.Position != 1 {
+		t.Errorf("third ticket = %+v, want position 1", ticket)
+	}
+}
+
+func TestDropExpiredWaiters(t *testing.T) {
+	operator := newTestOperator(newFakeDocker(), newFakeDatabase())
+	operator.config.Pool.MaxTotal = 0
+
+	expired, err := operator.Enqueue("", "", "expired", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alive, err := operator.Enqueue("", "", "alive", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operator.mutex.Lock()
+	operator.waiters[expired.ID].expiresAt = time.Now().Add(-time.Second)
+	abandoned := operator.dropExpiredWaiters()
+	position := operator.getPosition(operator.waiters[alive.ID])
+	_, found := operator.waiters[expired.ID]
+	operator.mutex.Unlock()
+
+	if len(abandoned) != 0 {
+		t.Errorf("abandoned = %v, want none", abandoned)
+	}
+
+	if found {
+		t.Errorf("expired waiter is not dropped")
+	}
+
+	if position != 1 {
+		t.Errorf("position of alive waiter = %d, want 1", position)
+	}
+
+	_, err = operator.WaitInQueue(context.Background(), expired.ID, 0)
+	if err != ErrTicketNotFound {
+		t.Errorf("WaitInQueue(expired) = %v, want ErrTicketNotFound", err)
+	}
+}
+
+func TestAllocateWhileQueued(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		// waiter is modified before allocation
+		waiter  func(waiter *waiter)
+		wantErr error
+	}{
+		{
+			name:    "other pool",
+			version: "6.8.0",
+		},
+		{
+			name:    "same pool",
+			version: "7.6.0",
+			wantErr: ErrRequestsQueued,
+		},
+		{
+			name:    "same pool, request is being served",
+			version: "7.6.0",
+			waiter: func(waiter *waiter) {
+				waiter.serving = true
+			},
+		},
+		{
+			name:    "same pool, request is expired",
+			version: "7.6.0",
+			waiter: func(waiter *waiter) {
+				waiter.expiresAt = time.Now().Add(-time.Second)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			free := newTestContainer("c1", "Up 5 minutes", 0)
+			other := newTestContainer("c2", "Up 5 minutes", 0)
+			other.Labels[constants.LABEL_POOL] = "7.6.0"
+
+			operator := newTestOperator(
+				newFakeDocker(free, other), newFakeDatabase(),
+			)
+
+			// the waiter of 7.6.0 pool is not served since the pool is full
+			operator.config.Pool.MaxTotal = 0
+			ticket, err := operator.Enqueue("7.6.0", "", "waiter", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.waiter != nil {
+				operator.mutex.Lock()
+				test.waiter(operator.waiters[ticket.ID])
+				operator.mutex.Unlock()
+			}
+
+			ctx := context.Background()
+
+			_, err = operator.AllocateContainer(
+				ctx, test.version, "", "newcomer", 0,
+			)
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("AllocateContainer() = %v, want nil", err)
+			case test.wantErr != nil && !karma.Contains(err, test.wantErr):
+				t.Errorf("AllocateContainer() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/kovetskiy/stash"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+// ReconcileResult describes what has been done with a container during
+// reconciliation.
+type ReconcileResult struct {
+	ContainerID string `json:"containerID"`
+	Name        string `json:"name"`
+	Action      string `json:"action"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Reconcile inspects every managed container: exited containers are
+// restarted, containers with Bitbucket not started, addon not enabled or
+// stale image or addon are replaced, containers of unknown pool or profile
+// are removed. Leased containers are never removed, only reported. At most
+// provisioning.concurrency containers are checked at once.
+func (operator *Operator) Reconcile(
+	ctx context.Context,
+) ([]ReconcileResult, error) {
+	log.Info("reconciling containers")
+
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	var (
+		mutex   sync.Mutex
+		group   sync.WaitGroup
+		results = []ReconcileResult{}
+	)
+
+	for _, container := range containers {
+		name := strings.TrimPrefix(container.Names[0], "/")
+
+		// containers are checked within provisioning slots, so reconcile
+		// doesn't check more containers at once than can be provisioned
+		select {
+		case operator.slots <- struct{}{}:
+		case <-ctx.Done():
+			group.Wait()
+
+			return nil, ctx.Err()
+		}
+
+		operator.mutex.Lock()
+		if operator.isProvisioning(container) {
+			operator.mutex.Unlock()
+			operator.releaseSlot()
+			continue
+		}
+
+		leased := operator.getLeaseByContainerID(container.ID) != nil
+		if !leased {
+			// held, so the container can't be allocated while checked
+			operator.holdContainer(container)
+		}
+		operator.mutex.Unlock()
+
+		group.Add(1)
+		go func(container types.Container) {
+			defer group.Done()
+			defer operator.releaseSlot()
+
+			result := operator.reconcileContainer(ctx, container, leased)
+			result.ContainerID = container.ID
+			result.Name = name
+
+			if !leased {
+				operator.unholdContainers([]types.Container{container})
+			}
+
+			log.Infof(
+				karma.Describe("action", result.Action).
+					Describe("reason", result.Reason),
+				"container reconciled, container_id: %s",
+				container.ID,
+			)
+
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}(container)
+	}
+
+	group.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	operator.notifyReplenisher()
+	operator.notifyQueue()
+
+	return results, nil
+}
+
+// ReconcileOnStart reconciles containers once the manager is started, the
+// manager isn't ready until reconciliation is finished, even if it fails.
+func (operator *Operator) ReconcileOnStart(ctx context.Context) {
+	_, err := operator.Reconcile(ctx)
+	if err != nil {
+		log.Errorf(err, "unable to reconcile containers")
+	}
+
+	operator.mutex.Lock()
+	operator.reconciled = true
+	operator.mutex.Unlock()
+}
+
+func (operator *Operator) reconcileContainer(
+	ctx context.Context,
+	container types.Container,
+	leased bool,
+) ReconcileResult {
+	pool, profile, reason := operator.getStaleReason(container)
+	if reason != "" {
+		return operator.discardContainer(
+			ctx, container, leased, pool, profile, reason,
+		)
+	}
+
+	action := constants.RECONCILE_ACTION_KEPT
+
+	status := handleStatusOfContainer(container.Status)
+	if status != constants.CONTAINER_STATUS_UP {
+		log.Infof(nil, "restarting container, container_id: %s", container.ID)
+
+		err := operator.docker.StartContainer(ctx, container.ID)
+		if err != nil {
+			return operator.discardContainer(
+				ctx, container, leased, pool, profile, err.Error(),
+			)
+		}
+
+		action = constants.RECONCILE_ACTION_RESTARTED
+	}
+
+	data := operator.getContainerData(container)
+	bitbucketURL := operator.GetURI("", data.PortHTTP)
+
+	err := operator.ValidateStartupStatus(
+		ctx, bitbucketURL, &data, newDetachedJob(ctx),
+	)
+	if err != nil {
+		return operator.discardContainer(
+			ctx, container, leased, pool, profile, err.Error(),
+		)
+	}
+
+	err = operator.validateAddon(ctx, bitbucketURL, *profile)
+	if err != nil {
+		return operator.discardContainer(
+			ctx, container, leased, pool, profile, err.Error(),
+		)
+	}
+
+	return ReconcileResult{Action: action}
+}
+
+// getStaleReason returns pool and profile of the container and the reason
+// why the container doesn't match the configuration anymore, pool and
+// profile are nil if they are not configured anymore.
+func (operator *Operator) getStaleReason(
+	container types.Container,
+) (*config.BitbucketPool, *config.Profile, string) {
+	pool, err := operator.getPool(getPoolOfContainer(container))
+	if err != nil {
+		return nil, nil, err.Error()
+	}
+
+	profile, err := operator.getProfile(
+		container.Labels[constants.LABEL_PROFILE],
+	)
+	if err != nil {
+		return nil, nil, err.Error()
+	}
+
+	image, err := getBitbucketImageWithVersion(profile.Image, pool.Version)
+	if err != nil {
+		return nil, nil, err.Error()
+	}
+
+	if label, ok := container.Labels[constants.LABEL_IMAGE]; ok &&
+		label != image {
+		return pool, profile, "stale image: " + label
+	}
+
+	if label, ok := container.Labels[constants.LABEL_ADDON_HASH]; ok {
+		hash, err := getFileHash(profile.Addons...)
+		if err != nil {
+			log.Errorf(
+				err,
+				"unable to get hash of addons",
+			)
+		} else if label != hash {
+			return pool, profile, "stale addon"
+		}
+	}
+
+	return pool, profile, ""
+}
+
+// discardContainer removes the broken or stale container, containers of
+// configured pools and profiles are replaced. Leased containers are kept.
+func (operator *Operator) discardContainer(
+	ctx context.Context,
+	container types.Container,
+	leased bool,
+	pool *config.BitbucketPool,
+	profile *config.Profile,
+	reason string,
+) ReconcileResult {
+	if leased {
+		return ReconcileResult{
+			Action: constants.RECONCILE_ACTION_REPORTED,
+			Reason: reason,
+		}
+	}
+
+	err := operator.RemoveContainers(ctx, []types.Container{container})
+	if err != nil {
+		log.Errorf(
+			err,
+			"unable to remove container, container_id: %s",
+			container.ID,
+		)
+
+		return ReconcileResult{
+			Action: constants.RECONCILE_ACTION_REPORTED,
+			Reason: reason,
+		}
+	}
+
+	if pool == nil {
+		return ReconcileResult{
+			Action: constants.RECONCILE_ACTION_REMOVED,
+			Reason: reason,
+		}
+	}
+
+	// containers of the default profile are provisioned by the replenisher
+	if profile.Name != "" {
+		go func() {
+			_, err := operator.HandleNewContainer(
+				context.Background(), pool.Version, profile.Name,
+			)
+			if err != nil {
+				log.Errorf(
+					err,
+					"unable to provision replacement for container, container_id: %s",
+					container.ID,
+				)
+			}
+		}()
+	}
+
+	return ReconcileResult{
+		Action: constants.RECONCILE_ACTION_REPLACED,
+		Reason: reason,
+	}
+}
+
+func (operator *Operator) validateAddon(
+	ctx context.Context,
+	bitbucketURL string,
+	profile config.Profile,
+) error {
+	addon, err := operator.getAddon(ctx, bitbucketURL, profile)
+	if err != nil {
+		return err
+	}
+
+	if !addon.Enabled {
+		return karma.Describe("addon", profile.AddonKey).
+			Reason(errors.New("addon is not enabled"))
+	}
+
+	return nil
+}
+
+// getAddon returns the addon of the profile installed to Bitbucket.
+func (operator *Operator) getAddon(
+	ctx context.Context,
+	bitbucketURL string,
+	profile config.Profile,
+) (*stash.Addon, error) {
+	parsedURL, err := url.Parse(bitbucketURL)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to parse url: %s",
+			bitbucketURL,
+		)
+	}
+
+	client := stash.NewClient(
+		operator.config.Bitbucket.Username,
+		operator.config.Bitbucket.Password,
+		parsedURL,
+	)
+
+	var token string
+	err = operator.callWithTimeout(ctx, func() (err error) {
+		token, err = client.GetUPMToken()
+		return err
+	})
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get upm token by url: %s",
+			parsedURL,
+		)
+	}
+
+	var addon stash.Addon
+	err = operator.callWithTimeout(ctx, func() (err error) {
+		addon, err = client.GetAddon(token, profile.AddonKey)
+		return err
+	})
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to get addon: %s",
+			profile.AddonKey,
+		)
+	}
+
+	return &addon, nil
+}
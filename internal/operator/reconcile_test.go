@@ -0,0 +1,66 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/constants"
+)
+
+func TestReconcileConcurrency(t *testing.T) {
+	docker := newFakeDocker()
+	for i := 0; i < 5; i++ {
+		container := newTestContainer(fmt.Sprintf("c%d", i), "Up 5 minutes", 0)
+		container.Labels[constants.LABEL_POOL] = "5.0.0"
+		docker.containers[container.ID] = container
+	}
+
+	operator := newTestOperator(docker, newFakeDatabase())
+
+	var (
+		mutex  sync.Mutex
+		active int
+		max    int
+	)
+
+	docker.onRemove = func() {
+		mutex.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+	}
+
+	if operator.CheckReconciled() != ErrNotReconciled {
+		t.Fatalf("manager is reconciled before reconcile has run")
+	}
+
+	operator.ReconcileOnStart(context.Background())
+
+	if err := operator.CheckReconciled(); err != nil {
+		t.Errorf("CheckReconciled() = %v, want nil", err)
+	}
+
+	if len(docker.removed) != 5 {
+		t.Errorf("removed = %v, want 5 containers", docker.removed)
+	}
+
+	limit := operator.config.Provisioning.Concurrency
+	if max > limit {
+		t.Errorf("containers reconciled at once = %d, want at most %d", max, limit)
+	}
+
+	if len(operator.provisioning) != 0 {
+		t.Errorf("provisioning = %v, want empty", operator.provisioning)
+	}
+}
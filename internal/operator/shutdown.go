@@ -0,0 +1,115 @@
+package operator
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+// Drain stops accepting allocations and provisioning, queued requests are
+// dropped. Provisioning in progress is waited for until timeout passes, then
+// remaining jobs are cancelled and their containers are removed.
+func (operator *Operator) Drain(timeout time.Duration) {
+	log.Info("draining: allocations and provisioning are stopped")
+
+	operator.mutex.Lock()
+	operator.draining = true
+
+	var abandoned []*LeasedContainer
+	for _, waiter := range operator.waiters {
+		container := operator.dropWaiter(waiter, ErrShuttingDown)
+		if container != nil {
+			abandoned = append(abandoned, container)
+		}
+	}
+	operator.mutex.Unlock()
+
+	operator.releaseAbandoned(context.Background(), abandoned)
+
+	if operator.waitForProvisioning(timeout) {
+		return
+	}
+
+	log.Warningf(
+		nil,
+		"provisioning hasn't finished in %s, cancelling jobs",
+		timeout,
+	)
+
+	operator.mutex.Lock()
+	for _, job := range operator.jobs {
+		job.cancel()
+	}
+	operator.mutex.Unlock()
+
+	if !operator.waitForProvisioning(timeout) {
+		log.Warningf(
+			nil,
+			"cancelled provisioning hasn't finished in %s, "+
+				"containers may be left behind",
+			timeout,
+		)
+	}
+}
+
+// waitForProvisioning returns false if some containers are still being
+// provisioned when timeout passes.
+func (operator *Operator) waitForProvisioning(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		operator.mutex.Lock()
+		provisioning := len(operator.provisioning)
+		operator.mutex.Unlock()
+
+		if provisioning == 0 {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		log.Infof(
+			nil,
+			"waiting for provisioning to finish, containers: %d",
+			provisioning,
+		)
+
+		time.Sleep(time.Second)
+	}
+}
+
+// RemoveFreeContainers removes all containers which are not leased, it's
+// used to tear the pool down on shutdown.
+func (operator *Operator) RemoveFreeContainers(ctx context.Context) error {
+	containers, err := operator.getManagedContainers(ctx)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to get containers from docker",
+		)
+	}
+
+	free := []types.Container{}
+
+	operator.mutex.Lock()
+	for _, container := range containers {
+		if operator.isProvisioning(container) {
+			continue
+		}
+
+		if operator.getLeaseByContainerID(container.ID) != nil {
+			continue
+		}
+
+		free = append(free, container)
+	}
+	operator.mutex.Unlock()
+
+	log.Infof(nil, "tearing pool down, free containers: %d", len(free))
+
+	return operator.RemoveContainers(ctx, free)
+}
@@ -0,0 +1,39 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainRejectsAllocations(t *testing.T) {
+	docker := newFakeDocker(newTestContainer("c1", "Up 5 minutes", 0))
+	operator := newTestOperator(docker, newFakeDatabase())
+
+	operator.Drain(time.Second)
+
+	ctx := context.Background()
+
+	_, err := operator.AllocateContainer(ctx, "", "", "", 0)
+	if err != ErrShuttingDown {
+		t.Errorf("AllocateContainer() = %v, want ErrShuttingDown", err)
+	}
+
+	_, err = operator.CreateFreeContainer(ctx, "", "", "", 0)
+	if err != ErrShuttingDown {
+		t.Errorf("CreateFreeContainer() = %v, want ErrShuttingDown", err)
+	}
+
+	_, err = operator.Enqueue("", "", "", 0)
+	if err != ErrShuttingDown {
+		t.Errorf("Enqueue() = %v, want ErrShuttingDown", err)
+	}
+
+	operator.mutex.Lock()
+	leases := len(operator.leases)
+	operator.mutex.Unlock()
+
+	if leases != 0 {
+		t.Errorf("leases = %d, want none", leases)
+	}
+}
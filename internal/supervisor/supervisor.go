@@ -0,0 +1,205 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+)
+
+// Status describes a background worker, errors are counted since start,
+// the worker is retried with backoff after failures.
+type Status struct {
+	Name              string     `json:"name"`
+	Running           bool       `json:"running"`
+	Runs              int        `json:"runs"`
+	Errors            int        `json:"errors"`
+	ConsecutiveErrors int        `json:"consecutiveErrors"`
+	LastError         string     `json:"lastError,omitempty"`
+	LastErrorAt       *time.Time `json:"lastErrorAt,omitempty"`
+	LastRunAt         *time.Time `json:"lastRunAt,omitempty"`
+	NextRunAt         *time.Time `json:"nextRunAt,omitempty"`
+}
+
+// Supervisor runs background workers, a failed or panicked worker doesn't
+// stop the manager, it's retried with exponential backoff instead.
+type Supervisor struct {
+	config config.Supervisor
+
+	mutex   sync.Mutex
+	workers []*worker
+	ctx     context.Context
+	stop    context.CancelFunc
+	group   sync.WaitGroup
+}
+
+type worker struct {
+	run      func(context.Context) error
+	interval time.Duration
+	wake     <-chan struct{}
+	status   Status
+}
+
+func NewSupervisor(config config.Supervisor) *Supervisor {
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &Supervisor{
+		config: config,
+		ctx:    ctx,
+		stop:   stop,
+	}
+}
+
+// Go starts the worker which is run every interval and every time wake
+// receives, wake may be nil. Context passed to the worker is cancelled once
+// the supervisor is stopped.
+func (supervisor *Supervisor) Go(
+	name string,
+	interval time.Duration,
+	wake <-chan struct{},
+	run func(context.Context) error,
+) {
+	worker := &worker{
+		run:      run,
+		interval: interval,
+		wake:     wake,
+		status: Status{
+			Name: name,
+		},
+	}
+
+	supervisor.mutex.Lock()
+	supervisor.workers = append(supervisor.workers, worker)
+	supervisor.mutex.Unlock()
+
+	supervisor.group.Add(1)
+	go supervisor.serve(worker)
+}
+
+// Stop stops all workers and waits for running ones to finish.
+func (supervisor *Supervisor) Stop() {
+	supervisor.stop()
+	supervisor.group.Wait()
+}
+
+func (supervisor *Supervisor) GetStatuses() []Status {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	statuses := []Status{}
+	for _, worker := range supervisor.workers {
+		statuses = append(statuses, worker.status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// GetStatus returns status of the worker with given name, false is returned
+// if there is no such worker.
+func (supervisor *Supervisor) GetStatus(name string) (Status, bool) {
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+
+	for _, worker := range supervisor.workers {
+		if worker.status.Name == name {
+			return worker.status, true
+		}
+	}
+
+	return Status{}, false
+}
+
+func (supervisor *Supervisor) serve(worker *worker) {
+	defer supervisor.group.Done()
+
+	for {
+		supervisor.mutex.Lock()
+		worker.status.Running = true
+		supervisor.mutex.Unlock()
+
+		err := call(supervisor.ctx, worker.run)
+
+		now := time.Now()
+		delay := worker.interval
+
+		supervisor.mutex.Lock()
+		worker.status.Running = false
+		worker.status.Runs++
+		worker.status.LastRunAt = &now
+
+		if err != nil {
+			worker.status.Errors++
+			worker.status.ConsecutiveErrors++
+			worker.status.LastError = err.Error()
+			worker.status.LastErrorAt = &now
+
+			delay = supervisor.getBackoff(worker.status.ConsecutiveErrors)
+		} else {
+			worker.status.ConsecutiveErrors = 0
+		}
+
+		next := now.Add(delay)
+		worker.status.NextRunAt = &next
+		supervisor.mutex.Unlock()
+
+		if err != nil {
+			log.Errorf(
+				err,
+				"worker %s failed, retrying in %s",
+				worker.status.Name,
+				delay,
+			)
+		}
+
+		// wake-ups are ignored while backing off, so a failing worker isn't
+		// hammered by notifications
+		var wake <-chan struct{}
+		if err == nil {
+			wake = worker.wake
+		}
+
+		select {
+		case <-supervisor.ctx.Done():
+			return
+		case <-wake:
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (supervisor *Supervisor) getBackoff(errors int) time.Duration {
+	backoff := supervisor.config.MinBackoff
+	for i := 1; i < errors && backoff < supervisor.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > supervisor.config.MaxBackoff {
+		backoff = supervisor.config.MaxBackoff
+	}
+
+	return backoff
+}
+
+// call runs the worker and turns its panic into an error.
+func call(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			err = karma.Format(
+				fmt.Errorf("%v", recovered),
+				"worker panicked",
+			)
+		}
+	}()
+
+	return run(ctx)
+}
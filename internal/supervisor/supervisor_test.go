@@ -0,0 +1,38 @@
+package supervisor
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+)
+
+func TestGetBackoff(t *testing.T) {
+	supervisor := NewSupervisor(config.Supervisor{
+		MinBackoff: time.Second,
+		MaxBackoff: 10 * time.Second,
+	})
+
+	tests := []struct {
+		errors   int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		backoff := supervisor.getBackoff(test.errors)
+		if backoff != test.expected {
+			t.Errorf(
+				"getBackoff(%d) = %s, want %s",
+				test.errors, backoff, test.expected,
+			)
+		}
+	}
+}
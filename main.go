@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/docker/docker/client"
 	"github.com/docopt/docopt-go"
@@ -10,10 +13,12 @@ import (
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/config"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/database"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/docker"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/handler"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/operator"
 	"gitlab.com/reconquest/bitbucket-pool-manager/internal/options"
+	"gitlab.com/reconquest/bitbucket-pool-manager/internal/supervisor"
 )
 
 var version = "[manual build]"
@@ -74,37 +79,59 @@ func main() {
 		log.Fatal(err)
 	}
 
-	docker := docker.NewDocker(cli, config)
+	dockerService := docker.NewDocker(cli, config)
 
-	operator := operator.NewOperator(config, docker, opts)
-	err = operator.CreateNetwork()
+	database, err := database.NewDatabase(config.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = operator.CleanAllocatedContainers()
+	operator := operator.NewOperator(config, dockerService, database, opts)
+	err = operator.CreateNetwork(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go func() {
-		for {
-			time.Sleep(20 * time.Second)
-			err = operator.CleanAllocatedContainers()
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}()
+	err = operator.RestoreState(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go func() {
-		err = operator.RunInitialContainers()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+	// not fatal: leases are cleaned by the cleaner worker later
+	err = operator.CleanAllocatedContainers(context.Background())
+	if err != nil {
+		log.Errorf(err, "unable to clean allocated containers")
+	}
+
+	collector := docker.NewGarbageCollector(dockerService)
 
-	handler := handler.NewHandler(config, operator)
+	supervisor := supervisor.NewSupervisor(config.Supervisor)
+	supervisor.Go(
+		"cleaner",
+		config.Cleaner.Interval,
+		nil,
+		operator.CleanAllocatedContainers,
+	)
+	supervisor.Go(
+		"replenisher",
+		config.Pool.ReplenishInterval,
+		operator.ReplenishNotifications(),
+		operator.ReplenishPool,
+	)
+	supervisor.Go(
+		"queue",
+		config.Pool.ReplenishInterval,
+		operator.QueueNotifications(),
+		operator.ServeQueue,
+	)
+	supervisor.Go(
+		"gc",
+		config.GC.Interval,
+		nil,
+		collector.Collect,
+	)
+
+	handler := handler.NewHandler(config, operator, collector, supervisor)
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc(config.BaseURL+"/container/all", handler.GetAllContainers)
@@ -120,10 +147,106 @@ func main() {
 	router.HandleFunc(
 		config.BaseURL+"/container/{id}", handler.RemoveContainer,
 	).Methods("DELETE")
+	router.HandleFunc(
+		config.BaseURL+"/container/{id}/renew", handler.RenewLease,
+	).Methods("POST")
+	router.HandleFunc(
+		config.BaseURL+"/container/{id}/release", handler.ReleaseContainer,
+	).Methods("POST")
+	router.HandleFunc(
+		config.BaseURL+"/container/{id}/leases", handler.GetLeasesOfContainer,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/quarantine", handler.GetQuarantinedContainers,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/gc/orphans", handler.GetOrphans,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/admin/reconcile", handler.Reconcile,
+	).Methods("POST")
+	router.HandleFunc(
+		config.BaseURL+"/status", handler.GetStatus,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURLV2+"/instances", handler.GetInstances,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURLV2+"/instances/{id}", handler.GetInstance,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURLV2+"/freeinstance", handler.GetFreeInstance,
+	).Methods("GET")
+	router.HandleFunc("/metrics", handler.GetMetrics).Methods("GET")
+	router.HandleFunc("/healthz", handler.GetHealth).Methods("GET")
+	router.HandleFunc("/readyz", handler.GetReadiness).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/jobs", handler.GetJobs,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/jobs/{id}", handler.GetJob,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/jobs/{id}", handler.CancelJob,
+	).Methods("DELETE")
+	router.HandleFunc(
+		config.BaseURL+"/jobs/{id}/events", handler.GetJobEvents,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/container/{id}/events", handler.GetContainerEvents,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/queue", handler.Enqueue,
+	).Methods("POST")
+	router.HandleFunc(
+		config.BaseURL+"/queue/{id}", handler.GetTicket,
+	).Methods("GET")
+	router.HandleFunc(
+		config.BaseURL+"/queue/{id}", handler.CancelTicket,
+	).Methods("DELETE")
+
+	server := &http.Server{
+		Addr:    config.ListeningPort,
+		Handler: router,
+	}
+
+	go func() {
+		log.Infof(nil, "listening on %s", config.ListeningPort)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf(err, "unable to listen and serve")
+		}
+	}()
+
+	// may take up to provisioning.startup_timeout, so it's done while the
+	// server is listening, the manager isn't ready until it's finished; not
+	// fatal: reconcile can be repeated with the admin endpoint
+	go operator.ReconcileOnStart(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	log.Infof(nil, "listening on %s", config.ListeningPort)
-	err = http.ListenAndServe(config.ListeningPort, router)
+	log.Infof(nil, "received signal %s, shutting down", <-signals)
+
+	operator.Drain(config.Shutdown.Timeout)
+	supervisor.Stop()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), config.Shutdown.Timeout,
+	)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
 	if err != nil {
-		log.Fatalf(err, "unable to listen and serve")
+		log.Errorf(err, "unable to shut http server down gracefully")
 	}
+
+	if config.Shutdown.Teardown {
+		err = operator.RemoveFreeContainers(context.Background())
+		if err != nil {
+			log.Errorf(err, "unable to tear pool down")
+		}
+	}
+
+	log.Info("bitbucket-pool-manager stopped")
 }